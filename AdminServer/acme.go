@@ -0,0 +1,229 @@
+package AdminServer
+
+import (
+	"bflog/DnsServer"
+	"bflog/config"
+	"bflog/db"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// acme-dns 接口的请求和响应格式与 https://github.com/joohoi/acme-dns 保持一致, 以便 certbot/lego 直接使用
+
+type acmeRegisterRequest struct {
+	AllowFrom []string `json:"allowfrom"`
+}
+
+type acmeRegisterResponse struct {
+	Username   string   `json:"username"`
+	Password   string   `json:"password"`
+	Fulldomain string   `json:"fulldomain"`
+	Subdomain  string   `json:"subdomain"`
+	AllowFrom  []string `json:"allowfrom"`
+}
+
+type acmeUpdateRequest struct {
+	Subdomain string `json:"subdomain"`
+	Txt       string `json:"txt"`
+}
+
+func sendAcmeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func sendAcmeError(w http.ResponseWriter, status int, message string) {
+	sendAcmeJSON(w, status, map[string]string{"error": message})
+}
+
+// newUUID 生成随机的 UUIDv4
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// newAcmePassword 生成 40 位的随机密码
+func newAcmePassword() (string, error) {
+	const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+	b := make([]byte, 40)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = alphabet[int(b[i])%len(alphabet)]
+	}
+	return string(b), nil
+}
+
+// acmeClientIP 返回调用方地址, 经过 nginx 时取 X-Real-Ip
+func acmeClientIP(r *http.Request) net.IP {
+	addr := r.RemoteAddr
+	if config.GetBase().Nginx == 1 {
+		addr = strings.Split(r.Header.Get("X-Real-Ip"), ",")[0]
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(strings.TrimSpace(addr))
+}
+
+// validAcmeTxt ACME DNS-01 的 TXT 值是 43 位的 base64url
+func validAcmeTxt(txt string) bool {
+	if len(txt) != 43 {
+		return false
+	}
+	for _, c := range txt {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func acmeRegister(w http.ResponseWriter, r *http.Request) {
+	if !config.GetBase().Dns.Acme.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		sendAcmeError(w, http.StatusMethodNotAllowed, "method_not_allowed")
+		return
+	}
+	if !config.GetBase().Dns.Acme.OpenRegister && !handleAuth(w, r) {
+		return
+	}
+	var req acmeRegisterRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendAcmeError(w, http.StatusBadRequest, "malformed_json_payload")
+			return
+		}
+	}
+	for _, cidr := range req.AllowFrom {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			sendAcmeError(w, http.StatusBadRequest, "invalid_allowfrom_cidr")
+			return
+		}
+	}
+	if req.AllowFrom == nil {
+		req.AllowFrom = []string{}
+	}
+
+	username, err := newUUID()
+	if err != nil {
+		sendAcmeError(w, http.StatusInternalServerError, "internal_error")
+		return
+	}
+	subdomain, err := newUUID()
+	if err != nil {
+		sendAcmeError(w, http.StatusInternalServerError, "internal_error")
+		return
+	}
+	password, err := newAcmePassword()
+	if err != nil {
+		sendAcmeError(w, http.StatusInternalServerError, "internal_error")
+		return
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		sendAcmeError(w, http.StatusInternalServerError, "internal_error")
+		return
+	}
+	allowFrom, _ := json.Marshal(req.AllowFrom)
+	account := db.AcmeAccount{
+		Username:  username,
+		Password:  string(hashedPassword),
+		Subdomain: subdomain,
+		AllowFrom: string(allowFrom),
+		CreatedAt: time.Now(),
+	}
+	if err := db.GetDB().RegisterAcmeAccount(account); err != nil {
+		logrus.Errorf("register acme account: %v", err)
+		sendAcmeError(w, http.StatusInternalServerError, "internal_error")
+		return
+	}
+	sendAcmeJSON(w, http.StatusCreated, acmeRegisterResponse{
+		Username:   username,
+		Password:   password,
+		Fulldomain: DnsServer.AcmeFullDomain(subdomain),
+		Subdomain:  subdomain,
+		AllowFrom:  req.AllowFrom,
+	})
+}
+
+func acmeUpdate(w http.ResponseWriter, r *http.Request) {
+	if !config.GetBase().Dns.Acme.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		sendAcmeError(w, http.StatusMethodNotAllowed, "method_not_allowed")
+		return
+	}
+	account, err := db.GetDB().GetAcmeAccount(r.Header.Get("X-Api-User"))
+	if err != nil {
+		sendAcmeError(w, http.StatusUnauthorized, "forbidden")
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(account.Password), []byte(r.Header.Get("X-Api-Key"))); err != nil {
+		sendAcmeError(w, http.StatusUnauthorized, "forbidden")
+		return
+	}
+	var allowFrom []string
+	_ = json.Unmarshal([]byte(account.AllowFrom), &allowFrom)
+	if len(allowFrom) > 0 {
+		ip := acmeClientIP(r)
+		allowed := false
+		for _, cidr := range allowFrom {
+			if _, network, err := net.ParseCIDR(cidr); err == nil && ip != nil && network.Contains(ip) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			sendAcmeError(w, http.StatusUnauthorized, "forbidden")
+			return
+		}
+	}
+
+	var req acmeUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendAcmeError(w, http.StatusBadRequest, "malformed_json_payload")
+		return
+	}
+	if req.Subdomain != account.Subdomain {
+		sendAcmeError(w, http.StatusUnauthorized, "forbidden")
+		return
+	}
+	if !validAcmeTxt(req.Txt) {
+		sendAcmeError(w, http.StatusBadRequest, "bad_txt")
+		return
+	}
+	if err := db.GetDB().UpdateAcmeTxt(req.Subdomain, req.Txt); err != nil {
+		logrus.Errorf("update acme txt: %v", err)
+		sendAcmeError(w, http.StatusInternalServerError, "internal_error")
+		return
+	}
+	// 立即刷新 DNS 服务器的内存表, CA 收到通知后马上就会查询
+	if err := DnsServer.ReloadAcmeTxt(); err != nil {
+		logrus.Errorf("reload acme txt: %v", err)
+	}
+	sendAcmeJSON(w, http.StatusOK, map[string]string{"txt": req.Txt})
+}
+
+func acmeHealth(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
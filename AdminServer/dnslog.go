@@ -1,6 +1,7 @@
 package AdminServer
 
 import (
+	"bflog/DnsServer"
 	"bflog/db"
 	"bflog/utils"
 	"encoding/json"
@@ -15,9 +16,11 @@ func getDnslogs(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 获取查询参数
-	receiveIP := r.URL.Query().Get("receiveip")
-	queryName := r.URL.Query().Get("queryname")
-	queryType := r.URL.Query().Get("querytype")
+	dnsFilter, err := utils.ParseDnslogFilter(r)
+	if err != nil {
+		sendJSONResponse(w, 1, "Invalid filter parameters.", nil)
+		return
+	}
 
 	// 默认分页参数
 	filter, err := utils.ParsePaginationAndTimeFilter(r)
@@ -26,8 +29,32 @@ func getDnslogs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// mode=aggregate 时按查询名, 解析器和类型在 window 秒内合并重复的查询, 默认 60 秒, 0 表示不分窗口.
+	// 公共解析器按 resolver_tag 合并, 未识别的解析器按来源地址分别合并.
+	// window 是按 Unix 时间对齐的固定区间, 跨过区间边界的突发会显示为相邻的两行
+	if r.URL.Query().Get("mode") == "aggregate" {
+		window := 60
+		if v := r.URL.Query().Get("window"); v != "" {
+			if window, err = strconv.Atoi(v); err != nil || window < 0 {
+				sendJSONResponse(w, 1, "Invalid window.", nil)
+				return
+			}
+		}
+		hits, totalCount, err := db.GetDB().GetDnslogHits(dnsFilter, window, filter)
+		if err != nil {
+			sendJSONResponse(w, 1, err.Error(), nil)
+			return
+		}
+		sendJSONResponse(w, 0, "success", DataResponse{
+			Items: utils.ConvertToInterfaceSlice(hits),
+			Total: totalCount,
+			Page:  filter.Page,
+		})
+		return
+	}
+
 	// 调用 GetDnslog 方法获取数据
-	logs, totalCount, err := db.GetDB().GetDnslog(receiveIP, queryName, queryType, filter)
+	logs, totalCount, err := db.GetDB().GetDnslog(dnsFilter, filter)
 	if err != nil {
 		sendJSONResponse(w, 1, err.Error(), nil)
 		//http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -143,3 +170,15 @@ func deleteAllDnsLogs(w http.ResponseWriter, r *http.Request) {
 	}
 	sendJSONResponse(w, 0, "success", nil)
 }
+
+func reloadResolvers(w http.ResponseWriter, r *http.Request) {
+	if !handleAuth(w, r) {
+		return
+	}
+	n, err := DnsServer.ReloadResolvers()
+	if err != nil {
+		sendJSONResponse(w, 1, err.Error(), nil)
+		return
+	}
+	sendJSONResponse(w, 0, "success", map[string]int{"ranges": n})
+}
@@ -1,17 +1,70 @@
 package AdminServer
 
 import (
+	"bflog/DnsServer"
 	"bflog/db"
 	"bflog/utils"
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
 	"net/http"
 	"strings"
 )
 
 type dnsrule struct {
-	Id         int    `json:"id"`
-	Name       string `json:"name"`
-	Ipaddresss string `json:"ip_addresses"`
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Ipaddresss 为记录值数组, 也兼容旧的逗号分隔字符串, 含逗号的 TXT 需要使用数组
+	Ipaddresss  db.DnsRuleValues `json:"ip_addresses"`
+	Strategy    string           `json:"strategy"`
+	StrategyArg int              `json:"strategy_arg"`
+	MatchType   string           `json:"match_type"`
+	Priority    int              `json:"priority"`
+	// Ttl 为空时使用默认 TTL
+	Ttl *uint32 `json:"ttl"`
+	// Probe 解析器行为探测方式, 留空表示正常应答
+	Probe    string `json:"probe"`
+	ProbeArg int    `json:"probe_arg"`
+}
+
+// reloadDnsRules 规则变更后立即刷新 DNS 服务器的内存规则表
+func reloadDnsRules() {
+	if err := DnsServer.ReloadRules(); err != nil {
+		logrus.Errorf("reload dns rules: %v", err)
+	}
+}
+
+// normalize 补全默认记录类型并校验每个记录值
+func (rule *dnsrule) normalize() error {
+	rule.Type = strings.ToUpper(strings.TrimSpace(rule.Type))
+	if rule.Type == "" {
+		rule.Type = "A"
+	}
+	if !db.IsDnsRuleType(rule.Type) {
+		return fmt.Errorf("不支持的记录类型: %s", rule.Type)
+	}
+	if !DnsServer.IsRebindStrategy(rule.Strategy) {
+		return fmt.Errorf("不支持的 rebinding 策略: %s", rule.Strategy)
+	}
+	rule.Probe = strings.ToLower(strings.TrimSpace(rule.Probe))
+	if !DnsServer.IsProbe(rule.Probe) {
+		return fmt.Errorf("不支持的探测方式: %s", rule.Probe)
+	}
+	if err := DnsServer.ValidateRulePattern(db.DnsRule{Name: rule.Name, MatchType: rule.MatchType}); err != nil {
+		return err
+	}
+	rule.Ipaddresss = rule.Ipaddresss.Trimmed()
+	if len(rule.Ipaddresss) == 0 {
+		return fmt.Errorf("记录值不能为空")
+	}
+	for _, value := range rule.Ipaddresss {
+		if err := DnsServer.ValidateRuleValue(rule.Type, value); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func getdnsrule(w http.ResponseWriter, r *http.Request) {
@@ -48,33 +101,33 @@ func adddnsrule(w http.ResponseWriter, r *http.Request) {
 		sendJSONResponse(w, 1, "Invalid request payload", nil)
 		return
 	}
+	if err := dns.normalize(); err != nil {
+		sendJSONResponse(w, 1, err.Error(), nil)
+		return
+	}
 
 	var existingRule db.DnsRule
-	if err := db.GetDB().Client.Where("name =?", dns.Name).First(&existingRule).Error; err == nil {
+	if err := db.GetDB().Client.Where("name =? and type = ?", dns.Name, dns.Type).First(&existingRule).Error; err == nil {
 		sendJSONResponse(w, 1, "name已存在", nil)
 		return
 	}
 	dnsrule := db.DnsRule{
 		Name:        dns.Name,
+		Type:        dns.Type,
 		IPAddresses: dns.Ipaddresss,
+		Strategy:    dns.Strategy,
+		StrategyArg: dns.StrategyArg,
+		MatchType:   dns.MatchType,
+		Priority:    dns.Priority,
+		Ttl:         dns.Ttl,
+		Probe:       dns.Probe,
+		ProbeArg:    dns.ProbeArg,
 	}
 	if err := db.GetDB().Client.Create(&dnsrule).Error; err != nil {
 		sendJSONResponse(w, 1, "添加错误", nil)
 		return
 	}
-	data := strings.Split(dns.Ipaddresss, ",")
-	const maxRetries = 3
-	var err error
-	for i := 0; i < maxRetries; i++ {
-		err = db.GetRedis().RPush(dns.Name, data)
-		if err == nil {
-			break // 成功写入 Redis
-		}
-	}
-	if err != nil {
-		sendJSONResponse(w, 1, "添加到 Redis 失败，已重试多次", nil)
-		return
-	}
+	reloadDnsRules()
 	sendJSONResponse(w, 0, "添加成功", nil)
 }
 
@@ -87,6 +140,10 @@ func updateDnsRule(w http.ResponseWriter, r *http.Request) {
 		sendJSONResponse(w, 1, "json解析失败", nil)
 		return
 	}
+	if err := dns.normalize(); err != nil {
+		sendJSONResponse(w, 1, err.Error(), nil)
+		return
+	}
 
 	var updatedDnsRule db.DnsRule
 	tx := db.GetDB().Client.Begin()
@@ -99,27 +156,25 @@ func updateDnsRule(w http.ResponseWriter, r *http.Request) {
 	existingRule.IPAddresses = dns.Ipaddresss
 	existingRule.ID = updatedDnsRule.ID
 	existingRule.Name = dns.Name
+	existingRule.Type = dns.Type
+	existingRule.Strategy = dns.Strategy
+	existingRule.StrategyArg = dns.StrategyArg
+	existingRule.MatchType = dns.MatchType
+	existingRule.Priority = dns.Priority
+	existingRule.Ttl = dns.Ttl
+	existingRule.Probe = dns.Probe
+	existingRule.ProbeArg = dns.ProbeArg
 	if err := tx.Save(&existingRule).Error; err != nil {
 		tx.Rollback()
 		sendJSONResponse(w, 1, "更新失败 ", nil)
 		//http.Error(w, "Failed to update DNS rule in MySQL", http.StatusInternalServerError)
 		return
 	}
-	data := strings.Split(dns.Ipaddresss, ",")
-	if err := db.GetRedis().Del(dns.Name); err != nil {
-		tx.Rollback()
-		sendJSONResponse(w, 1, "更新到redis失败 ", nil)
-		return
-	}
-	if err := db.GetRedis().RPush(dns.Name, data); err != nil {
-		tx.Rollback()
-		sendJSONResponse(w, 1, "更新到redis失败 ", nil)
-		return
-	}
 	if err := tx.Commit().Error; err != nil {
 		sendJSONResponse(w, 1, "Failed to commit transaction ", nil)
 		return
 	}
+	reloadDnsRules()
 	sendJSONResponse(w, 0, "更新成功", nil)
 }
 
@@ -128,7 +183,6 @@ func deleteDnsRule(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	name := r.URL.Query().Get("id")
 	id := r.URL.Query().Get("id")
 	// 启动事务
 
@@ -142,18 +196,50 @@ func deleteDnsRule(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 删除 Redis 中的数据
-	if err := db.GetRedis().Del(name); err != nil {
-		tx.Rollback()
-		sendJSONResponse(w, 1, "redis删除失败", nil)
-		return
-	}
-
 	// 提交事务
 	if err := tx.Commit().Error; err != nil {
 		sendJSONResponse(w, 1, "mysql删除失败", nil)
 		return
 	}
+	reloadDnsRules()
 
 	sendJSONResponse(w, 0, "删除成功", nil)
 }
+
+// importDnsRules 导入 RFC 1035 区域文件, 请求体为文件内容. apply=1 时写入数据库, 否则只返回预览
+func importDnsRules(w http.ResponseWriter, r *http.Request) {
+	if !handleAuth(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		sendJSONResponse(w, 1, "请使用 POST 上传区域文件", nil)
+		return
+	}
+	apply := r.URL.Query().Get("apply") == "1" || r.URL.Query().Get("apply") == "true"
+	result, err := DnsServer.ImportZoneFile(http.MaxBytesReader(w, r.Body, 4<<20), r.URL.Query().Get("origin"), apply)
+	if err != nil {
+		sendJSONResponse(w, 1, err.Error(), nil)
+		return
+	}
+	sendJSONResponse(w, 0, "success", result)
+}
+
+// exportDnsRules 把当前规则导出为区域文件
+func exportDnsRules(w http.ResponseWriter, r *http.Request) {
+	if !handleAuth(w, r) {
+		return
+	}
+	origin := r.URL.Query().Get("origin")
+	filename := "bflog.zone"
+	if origin != "" {
+		filename = strings.TrimSuffix(origin, ".") + ".zone"
+	}
+	var buf bytes.Buffer
+	if err := DnsServer.ExportZoneFile(&buf, origin); err != nil {
+		sendJSONResponse(w, 1, err.Error(), nil)
+		return
+	}
+	w.Header().Set("Content-Type", "text/dns; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	_, _ = w.Write(buf.Bytes())
+}
@@ -0,0 +1,113 @@
+package AdminServer
+
+import (
+	"bflog/DnsServer"
+	"bflog/db"
+	"bflog/utils"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// exfilSession 会话列表中的一项, 附带完整性和下载地址
+type exfilSession struct {
+	db.ExfilSession
+	Complete bool   `json:"complete"`
+	Download string `json:"download"`
+}
+
+func exfilDownloadURL(token string) string {
+	return "/api/exfildownload?token=" + url.QueryEscape(token)
+}
+
+func getExfilSessions(w http.ResponseWriter, r *http.Request) {
+	if !handleAuth(w, r) {
+		return
+	}
+	token := r.URL.Query().Get("token")
+	filter, err := utils.ParsePaginationAndTimeFilter(r)
+	if err != nil {
+		sendJSONResponse(w, 1, "Invalid pagination or time filter parameters.", nil)
+		return
+	}
+	sessions, totalCount, err := db.GetDB().GetExfilSessions(token, filter.Page, filter.PageSize)
+	if err != nil {
+		sendJSONResponse(w, 1, err.Error(), nil)
+		return
+	}
+	items := make([]exfilSession, 0, len(sessions))
+	for _, session := range sessions {
+		items = append(items, exfilSession{
+			ExfilSession: session,
+			Complete:     DnsServer.ExfilComplete(session),
+			Download:     exfilDownloadURL(session.Token),
+		})
+	}
+	data := DataResponse{
+		Items: utils.ConvertToInterfaceSlice(items),
+		Total: totalCount,
+		Page:  filter.Page,
+	}
+	sendJSONResponse(w, 0, "success", data)
+}
+
+// exfilDetail 重组结果以及下载地址
+type exfilDetail struct {
+	*DnsServer.ExfilPayload
+	Download string `json:"download"`
+}
+
+func getExfilSession(w http.ResponseWriter, r *http.Request) {
+	if !handleAuth(w, r) {
+		return
+	}
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		sendJSONResponse(w, 1, "缺少token", nil)
+		return
+	}
+	payload, err := DnsServer.ReassembleExfil(token)
+	if err != nil {
+		sendJSONResponse(w, 1, err.Error(), nil)
+		return
+	}
+	sendJSONResponse(w, 0, "success", exfilDetail{ExfilPayload: payload, Download: exfilDownloadURL(token)})
+}
+
+func downloadExfil(w http.ResponseWriter, r *http.Request) {
+	if !handleAuth(w, r) {
+		return
+	}
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		sendJSONResponse(w, 1, "缺少token", nil)
+		return
+	}
+	payload, err := DnsServer.ReassembleExfil(token)
+	if err != nil {
+		sendJSONResponse(w, 1, err.Error(), nil)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", token+".bin"))
+	w.Header().Set("Content-Length", strconv.Itoa(len(payload.Data)))
+	w.Header().Set("X-Exfil-Complete", strconv.FormatBool(payload.Complete))
+	_, _ = w.Write(payload.Data)
+}
+
+func deleteExfilSession(w http.ResponseWriter, r *http.Request) {
+	if !handleAuth(w, r) {
+		return
+	}
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		sendJSONResponse(w, 1, "缺少token", nil)
+		return
+	}
+	if err := db.GetDB().DeleteExfilSession(token); err != nil {
+		sendJSONResponse(w, 1, "删除失败", nil)
+		return
+	}
+	sendJSONResponse(w, 0, "success", nil)
+}
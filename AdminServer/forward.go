@@ -0,0 +1,41 @@
+package AdminServer
+
+import (
+	"bflog/db"
+	"bflog/utils"
+	"net/http"
+)
+
+// getForwardLogs 查询转发到上游的区域外查询
+func getForwardLogs(w http.ResponseWriter, r *http.Request) {
+	if !handleAuth(w, r) {
+		return
+	}
+	filter, err := utils.ParsePaginationAndTimeFilter(r)
+	if err != nil {
+		sendJSONResponse(w, 1, "Invalid pagination or time filter parameters.", nil)
+		return
+	}
+	q := r.URL.Query()
+	logs, totalCount, err := db.GetDB().GetForwardLogs(q.Get("receiveip"), q.Get("queryname"), q.Get("upstream"), filter)
+	if err != nil {
+		sendJSONResponse(w, 1, err.Error(), nil)
+		return
+	}
+	sendJSONResponse(w, 0, "success", DataResponse{
+		Items: utils.ConvertToInterfaceSlice(logs),
+		Total: totalCount,
+		Page:  filter.Page,
+	})
+}
+
+func deleteAllForwardLogs(w http.ResponseWriter, r *http.Request) {
+	if !handleAuth(w, r) {
+		return
+	}
+	if err := db.GetDB().DeleteAllForwardLogs(); err != nil {
+		sendJSONResponse(w, 1, "删除失败", nil)
+		return
+	}
+	sendJSONResponse(w, 0, "删除成功", nil)
+}
@@ -21,6 +21,7 @@ func getHttplogs(w http.ResponseWriter, r *http.Request) {
 	header := r.URL.Query().Get("header")
 	body := r.URL.Query().Get("body")
 	path := r.URL.Query().Get("path")
+	noise := r.URL.Query().Get("noise") == "1" || r.URL.Query().Get("noise") == "true"
 
 	filter, err := utils.ParsePaginationAndTimeFilter(r)
 	if err != nil {
@@ -29,7 +30,7 @@ func getHttplogs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	logs, totalCount, err := db.GetDB().GetHttplog(hostname, remoteaddr, method, url, header, body, path, filter)
+	logs, totalCount, err := db.GetDB().GetHttplog(hostname, remoteaddr, method, url, header, body, path, noise, filter)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
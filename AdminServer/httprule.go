@@ -1,13 +1,22 @@
 package AdminServer
 
 import (
+	"bflog/HttpServer"
 	"bflog/db"
 	"bflog/utils"
 	"encoding/json"
+	"github.com/sirupsen/logrus"
 	"net/http"
 	"strconv"
 )
 
+// reloadHttpRules 规则变更后立即刷新 HTTP 服务器的内存规则表
+func reloadHttpRules() {
+	if err := HttpServer.ReloadHttpRules(); err != nil {
+		logrus.Errorf("reload http rules: %v", err)
+	}
+}
+
 func getHttprules(w http.ResponseWriter, r *http.Request) {
 	if !handleAuth(w, r) { // 添加 CORS 头部，并检查授权
 		return
@@ -59,6 +68,7 @@ func deleteHttprule(w http.ResponseWriter, r *http.Request) {
 		//http.Error(w, "Failed to delete DNS log", http.StatusInternalServerError)
 		return
 	}
+	reloadHttpRules()
 
 	sendJSONResponse(w, 0, "DNS log deleted successfully", nil)
 }
@@ -79,6 +89,10 @@ func updateHttprule(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "ID is required for updating", http.StatusBadRequest)
 		return
 	}
+	if err := HttpServer.NormalizeHttpRule(&httpResponse); err != nil {
+		sendJSONResponse(w, 1, err.Error(), nil)
+		return
+	}
 	updateData := map[string]interface{}{
 		"Method":      httpResponse.Method,
 		"Path":        httpResponse.Path,
@@ -86,11 +100,15 @@ func updateHttprule(w http.ResponseWriter, r *http.Request) {
 		"Body":        httpResponse.Body,
 		"Header":      httpResponse.Header,
 		"RedirectUrl": httpResponse.RedirectUrl,
+		"MatchType":   httpResponse.MatchType,
+		"Priority":    httpResponse.Priority,
+		"Hostname":    httpResponse.Hostname,
 	}
 	if err := db.GetDB().Client.Model(&db.HttpResponse{}).Where("id = ?", httpResponse.ID).Updates(updateData).Error; err != nil {
 		http.Error(w, "Failed to update HTTP response", http.StatusInternalServerError)
 		return
 	}
+	reloadHttpRules()
 
 	sendJSONResponse(w, 0, "update success", nil)
 }
@@ -102,6 +120,9 @@ type HttpResponsePayload struct {
 	Body        string `json:"body,omitempty"`
 	Method      string `json:"method,omitempty"`
 	StatusCode  string `json:"statuscode"`
+	MatchType   string `json:"match_type,omitempty"`
+	Priority    int    `json:"priority,omitempty"`
+	Hostname    string `json:"hostname,omitempty"`
 }
 
 func AddHttpResponse(w http.ResponseWriter, r *http.Request) {
@@ -117,12 +138,6 @@ func AddHttpResponse(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var existingResponse db.HttpResponse
-	if err := db.GetDB().Client.Where("path = ? and method =?", payload.Path, payload.Method).First(&existingResponse).Error; err == nil {
-		sendJSONResponse(w, 1, "path已存在", nil)
-		return
-	}
-
 	// 设置创建和更新时间
 	httpResponse := db.HttpResponse{
 		Path:        payload.Path,
@@ -131,6 +146,19 @@ func AddHttpResponse(w http.ResponseWriter, r *http.Request) {
 		Header:      payload.Header,
 		Body:        payload.Body,
 		Method:      payload.Method,
+		MatchType:   payload.MatchType,
+		Priority:    payload.Priority,
+		Hostname:    payload.Hostname,
+	}
+	if err := HttpServer.NormalizeHttpRule(&httpResponse); err != nil {
+		sendJSONResponse(w, 1, err.Error(), nil)
+		return
+	}
+
+	var existingResponse db.HttpResponse
+	if err := db.GetDB().Client.Where("path = ? and method = ? and match_type = ? and hostname = ?", httpResponse.Path, httpResponse.Method, httpResponse.MatchType, httpResponse.Hostname).First(&existingResponse).Error; err == nil {
+		sendJSONResponse(w, 1, "path已存在", nil)
+		return
 	}
 
 	// 插入数据库
@@ -138,6 +166,7 @@ func AddHttpResponse(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to add HTTP response", http.StatusInternalServerError)
 		return
 	}
+	reloadHttpRules()
 
 	sendJSONResponse(w, 0, "添加成功", nil)
 }
@@ -0,0 +1,104 @@
+package AdminServer
+
+import (
+	"bflog/db"
+	"bflog/utils"
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+)
+
+// reloadNoiseRules 规则变更后立即刷新内存中的噪音规则表
+func reloadNoiseRules() {
+	if err := db.GetDB().ReloadNoiseRules(); err != nil {
+		logrus.Errorf("reload noise rules: %v", err)
+	}
+}
+
+// getNoiseRules 分页返回噪音规则, hits/last_hit 统计全部命中, 包括 ignore 这类不记录日志的命中
+func getNoiseRules(w http.ResponseWriter, r *http.Request) {
+	if !handleAuth(w, r) {
+		return
+	}
+	filter, err := utils.ParsePaginationAndTimeFilter(r)
+	if err != nil {
+		sendJSONResponse(w, 1, "Invalid pagination or time filter parameters.", nil)
+		return
+	}
+	rules, totalCount, err := db.GetDB().GetNoiseRules(r.URL.Query().Get("scope"), filter.Page, filter.PageSize)
+	if err != nil {
+		sendJSONResponse(w, 1, err.Error(), nil)
+		return
+	}
+	data := DataResponse{
+		Items: utils.ConvertToInterfaceSlice(rules),
+		Total: totalCount,
+		Page:  filter.Page,
+	}
+	sendJSONResponse(w, 0, "success", data)
+}
+
+func addNoiseRule(w http.ResponseWriter, r *http.Request) {
+	if !handleAuth(w, r) {
+		return
+	}
+	rule := db.NoiseRule{Enabled: true}
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		sendJSONResponse(w, 1, "Invalid request payload", nil)
+		return
+	}
+	if err := db.ValidateNoiseRule(&rule); err != nil {
+		sendJSONResponse(w, 1, err.Error(), nil)
+		return
+	}
+	rule.ID = 0
+	if err := db.GetDB().AddNoiseRule(rule); err != nil {
+		sendJSONResponse(w, 1, "添加错误", nil)
+		return
+	}
+	reloadNoiseRules()
+	sendJSONResponse(w, 0, "添加成功", nil)
+}
+
+func updateNoiseRule(w http.ResponseWriter, r *http.Request) {
+	if !handleAuth(w, r) {
+		return
+	}
+	var rule db.NoiseRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		sendJSONResponse(w, 1, "json解析失败", nil)
+		return
+	}
+	if rule.ID == 0 {
+		sendJSONResponse(w, 1, "缺少id", nil)
+		return
+	}
+	if err := db.ValidateNoiseRule(&rule); err != nil {
+		sendJSONResponse(w, 1, err.Error(), nil)
+		return
+	}
+	if err := db.GetDB().UpdateNoiseRule(rule); err != nil {
+		sendJSONResponse(w, 1, "更新失败", nil)
+		return
+	}
+	reloadNoiseRules()
+	sendJSONResponse(w, 0, "更新成功", nil)
+}
+
+func deleteNoiseRule(w http.ResponseWriter, r *http.Request) {
+	if !handleAuth(w, r) {
+		return
+	}
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		sendJSONResponse(w, 1, "id错误", nil)
+		return
+	}
+	if err := db.GetDB().DeleteNoiseRule(id); err != nil {
+		sendJSONResponse(w, 1, "删除失败", nil)
+		return
+	}
+	reloadNoiseRules()
+	sendJSONResponse(w, 0, "删除成功", nil)
+}
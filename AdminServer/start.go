@@ -87,8 +87,26 @@ func setupRoutes() {
 	mux.HandleFunc("/api/adddnsrule", adddnsrule)
 	mux.HandleFunc("/api/updatednsrule", updateDnsRule)
 	mux.HandleFunc("/api/deldnsrulebyid", deleteDnsRule)
+	mux.HandleFunc("/api/importdnsrules", importDnsRules)
+	mux.HandleFunc("/api/exportdnsrules", exportDnsRules)
+	mux.HandleFunc("/api/noiserules", getNoiseRules)
+	mux.HandleFunc("/api/addnoiserule", addNoiseRule)
+	mux.HandleFunc("/api/updatenoiserule", updateNoiseRule)
+	mux.HandleFunc("/api/delnoiserule", deleteNoiseRule)
 	mux.HandleFunc("/api/delallhttp", deleteAllHttpLogs)
 	mux.HandleFunc("/api/delalldns", deleteAllDnsLogs)
+	mux.HandleFunc("/api/reloadresolvers", reloadResolvers)
+	mux.HandleFunc("/api/dnsstats", getDnsStats)
+	mux.HandleFunc("/api/forwardlogs", getForwardLogs)
+	mux.HandleFunc("/api/delallforward", deleteAllForwardLogs)
+	// acme-dns 兼容接口, 路径与 acme-dns 相同
+	mux.HandleFunc("/register", acmeRegister)
+	mux.HandleFunc("/update", acmeUpdate)
+	mux.HandleFunc("/health", acmeHealth)
+	mux.HandleFunc("/api/exfilsessions", getExfilSessions)
+	mux.HandleFunc("/api/exfilsession", getExfilSession)
+	mux.HandleFunc("/api/exfildownload", downloadExfil)
+	mux.HandleFunc("/api/delexfil", deleteExfilSession)
 	port := ":" + config.GetBase().Server.Adminport
 
 	// 设置 CORS 中间件
@@ -0,0 +1,27 @@
+package AdminServer
+
+import (
+	"bflog/DnsServer"
+	"bflog/db"
+	"net/http"
+)
+
+// dnsStats DNS 服务器运行状态
+type dnsStats struct {
+	Pool    DnsServer.PoolStats    `json:"pool"`
+	Persist db.InsertStats         `json:"persist"`
+	Rrl     DnsServer.RRLStats     `json:"rrl"`
+	Forward DnsServer.ForwardStats `json:"forward"`
+}
+
+func getDnsStats(w http.ResponseWriter, r *http.Request) {
+	if !handleAuth(w, r) {
+		return
+	}
+	sendJSONResponse(w, 0, "success", dnsStats{
+		Pool:    DnsServer.GetPoolStats(),
+		Persist: db.GetDB().InsertStats(),
+		Rrl:     DnsServer.GetRRLStats(),
+		Forward: DnsServer.GetForwardStats(),
+	})
+}
@@ -0,0 +1,76 @@
+package DnsServer
+
+import (
+	"bflog/config"
+	"bflog/db"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// acmeRefreshInterval 定时从数据库重新加载 TXT 记录, 多实例部署时其他实例上的更新最多延迟这么久
+const acmeRefreshInterval = 10 * time.Second
+
+// acmeTable 当前生效的 map[string][]string, 子域名到 TXT 值
+var acmeTable atomic.Value
+
+// ReloadAcmeTxt 从数据库重新加载全部 acme-dns TXT 记录
+func ReloadAcmeTxt() error {
+	records, err := db.GetDB().GetAllAcmeTxt()
+	if err != nil {
+		return err
+	}
+	table := make(map[string][]string)
+	for _, record := range records {
+		table[record.Subdomain] = append(table[record.Subdomain], record.Value)
+	}
+	acmeTable.Store(table)
+	return nil
+}
+
+// refreshAcmeTxt 周期性重新加载 TXT 记录
+func refreshAcmeTxt() {
+	ticker := time.NewTicker(acmeRefreshInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := ReloadAcmeTxt(); err != nil {
+			logrus.Errorf("reload acme txt: %v", err)
+		}
+	}
+}
+
+// acmeTTL acme-dns TXT 记录的 TTL, 默认 1 秒, 保证 CA 验证时总能拿到最新的值
+func acmeTTL() uint32 {
+	return valueOr(config.GetBase().Dns.Acme.Ttl, 1)
+}
+
+// AcmeFullDomain 返回注册账号的子域名对应的完整域名, 使用第一个区域
+func AcmeFullDomain(subdomain string) string {
+	return subdomain + "." + removeTrailingDot(primaryZone().name)
+}
+
+// acmeAnswer 查询名为 <subdomain>.<zone> 且该子域名由 acme-dns 接口注册时返回它的 TXT 记录
+func acmeAnswer(q dns.Question, domain string, z *zone) ([]dns.RR, bool) {
+	if !config.GetBase().Dns.Acme.Enabled || q.Qtype != dns.TypeTXT {
+		return nil, false
+	}
+	subdomain, ok := strings.CutSuffix(domain, "."+removeTrailingDot(z.name))
+	if !ok || subdomain == "" || strings.Contains(subdomain, ".") {
+		return nil, false
+	}
+	table, _ := acmeTable.Load().(map[string][]string)
+	values := table[subdomain]
+	if len(values) == 0 {
+		return nil, false
+	}
+	var answer []dns.RR
+	for _, value := range values {
+		answer = append(answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: acmeTTL()},
+			Txt: []string{value},
+		})
+	}
+	return answer, true
+}
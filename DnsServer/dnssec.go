@@ -0,0 +1,265 @@
+package DnsServer
+
+import (
+	"bflog/config"
+	"crypto"
+	"fmt"
+	"github.com/miekg/dns"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dnskeyTTL = 3600
+	// 签名有效期, inception 往前留一小时容忍时钟偏差
+	sigValidity = 7 * 24 * time.Hour
+	sigSkew     = time.Hour
+)
+
+// zoneKeys 一个区域的 KSK 与 ZSK
+type zoneKeys struct {
+	ksk       *dns.DNSKEY
+	zsk       *dns.DNSKEY
+	kskSigner crypto.Signer
+	zskSigner crypto.Signer
+}
+
+var (
+	keysMu   sync.RWMutex
+	keyStore = make(map[string]*zoneKeys)
+)
+
+func dnssecEnabled() bool {
+	return config.GetBase().Dns.Dnssec.Enabled
+}
+
+func keyDir() string {
+	if dir := config.GetBase().Dns.Dnssec.KeyDir; dir != "" {
+		return dir
+	}
+	return "keys"
+}
+
+// LoadDnssecKeys 加载区域的 KSK/ZSK, 文件不存在时生成新的密钥并保存
+func LoadDnssecKeys(zone string) error {
+	ksk, kskSigner, err := loadOrGenerateKey(zone, "ksk", 257)
+	if err != nil {
+		return err
+	}
+	zsk, zskSigner, err := loadOrGenerateKey(zone, "zsk", 256)
+	if err != nil {
+		return err
+	}
+	keysMu.Lock()
+	keyStore[zone] = &zoneKeys{ksk: ksk, zsk: zsk, kskSigner: kskSigner, zskSigner: zskSigner}
+	keysMu.Unlock()
+	return nil
+}
+
+// loadOrGenerateKey 读取 <key_dir>/<zone><role>.key 和 .private, 不存在时生成 ECDSA P-256 密钥
+func loadOrGenerateKey(zone string, role string, flags uint16) (*dns.DNSKEY, crypto.Signer, error) {
+	base := filepath.Join(keyDir(), zone+role)
+	if pub, err := os.Open(base + ".key"); err == nil {
+		defer pub.Close()
+		rr, err := dns.ReadRR(pub, base+".key")
+		if err != nil {
+			return nil, nil, err
+		}
+		key, ok := rr.(*dns.DNSKEY)
+		if !ok {
+			return nil, nil, fmt.Errorf("%s.key is not a DNSKEY", base)
+		}
+		priv, err := os.Open(base + ".private")
+		if err != nil {
+			return nil, nil, err
+		}
+		defer priv.Close()
+		privateKey, err := key.ReadPrivateKey(priv, base+".private")
+		if err != nil {
+			return nil, nil, err
+		}
+		signer, ok := privateKey.(crypto.Signer)
+		if !ok {
+			return nil, nil, fmt.Errorf("%s.private is not a signing key", base)
+		}
+		return key, signer, nil
+	}
+
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: dnskeyTTL},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	privateKey, err := key.Generate(256)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := os.MkdirAll(keyDir(), 0700); err != nil {
+		return nil, nil, err
+	}
+	if err := os.WriteFile(base+".key", []byte(key.String()+"\n"), 0644); err != nil {
+		return nil, nil, err
+	}
+	if err := os.WriteFile(base+".private", []byte(key.PrivateKeyString(privateKey)), 0600); err != nil {
+		return nil, nil, err
+	}
+	return key, privateKey.(crypto.Signer), nil
+}
+
+func getZoneKeys(zone string) *zoneKeys {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+	return keyStore[zone]
+}
+
+// DSRecords 返回区域 KSK 的 DS 记录, 用于提交到注册商
+func DSRecords(zone string) ([]*dns.DS, error) {
+	keys := getZoneKeys(zone)
+	if keys == nil {
+		return nil, fmt.Errorf("no dnssec keys for %s", zone)
+	}
+	var records []*dns.DS
+	for _, digest := range []uint8{dns.SHA256, dns.SHA384} {
+		records = append(records, keys.ksk.ToDS(digest))
+	}
+	return records, nil
+}
+
+// dnskeyRecords 区域的 DNSKEY 记录集
+func dnskeyRecords(zone string) []dns.RR {
+	keys := getZoneKeys(zone)
+	if keys == nil {
+		return nil
+	}
+	return []dns.RR{keys.ksk, keys.zsk}
+}
+
+// nsecRecord 为 NODATA 应答构造只覆盖查询名自身的 NSEC ("black lies"),
+// 下一个名称为 \000.<name>, 不会泄露区域中的其他名称
+func nsecRecord(name string, types []uint16, ttl uint32) *dns.NSEC {
+	bitmap := append([]uint16{}, types...)
+	bitmap = append(bitmap, dns.TypeRRSIG, dns.TypeNSEC)
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: ttl},
+		NextDomain: "\\000." + name,
+		TypeBitMap: sortTypes(bitmap),
+	}
+}
+
+func sortTypes(types []uint16) []uint16 {
+	seen := make(map[uint16]bool, len(types))
+	var out []uint16
+	for _, t := range types {
+		if !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+// existingTypes 返回某个名称上会应答的记录类型, 用于 NSEC 的类型位图,
+// 与 authorityAnswer 和 buildAnswer 的应答保持一致, 否则验证方会认为否定证明与应答矛盾
+func existingTypes(name string, z *zone) []uint16 {
+	name = strings.ToLower(dns.Fqdn(name))
+	domain := removeTrailingDot(name)
+	var types []uint16
+	if name == z.name {
+		types = append(types, dns.TypeSOA, dns.TypeNS)
+		if dnssecEnabled() {
+			types = append(types, dns.TypeDNSKEY)
+		}
+	}
+	// 名称服务器只应答配置的 glue 地址
+	if z.isNameServer(name) {
+		for _, rr := range z.glueRecords(name, 0) {
+			types = append(types, rr.Header().Rrtype)
+		}
+		return types
+	}
+	// CNAME 规则对其他类型的查询同样生效, 这个名称上只有 CNAME
+	if name != z.name && lookupRule(domain, "CNAME") != nil {
+		return append(types, dns.TypeCNAME)
+	}
+	// 没有规则时 A/AAAA 使用区域的默认地址, 默认地址无效时 buildAnswer 不会应答
+	if _, err := newRR(name, dns.TypeA, z.cfg.DefaultIp, 0); err == nil || lookupRule(domain, "A") != nil {
+		types = append(types, dns.TypeA)
+	}
+	if _, err := newRR(name, dns.TypeAAAA, z.cfg.DefaultIpv6, 0); err == nil || lookupRule(domain, "AAAA") != nil {
+		types = append(types, dns.TypeAAAA)
+	}
+	if _, ok := acmeAnswer(dns.Question{Name: name, Qtype: dns.TypeTXT}, domain, z); ok || lookupRule(domain, "TXT") != nil {
+		types = append(types, dns.TypeTXT)
+	}
+	if lookupRule(domain, "MX") != nil {
+		types = append(types, dns.TypeMX)
+	}
+	return types
+}
+
+// signSection 为一个段中的每个记录集追加 RRSIG, DNSKEY 用 KSK 签名, 其他记录用 ZSK 签名
+func signSection(rrs []dns.RR, zone string, keys *zoneKeys) []dns.RR {
+	type setKey struct {
+		name  string
+		rtype uint16
+	}
+	var order []setKey
+	sets := make(map[setKey][]dns.RR)
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeRRSIG || rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		k := setKey{strings.ToLower(rr.Header().Name), rr.Header().Rrtype}
+		if _, ok := sets[k]; !ok {
+			order = append(order, k)
+		}
+		sets[k] = append(sets[k], rr)
+	}
+	now := time.Now()
+	out := rrs
+	for _, k := range order {
+		set := sets[k]
+		key, signer := keys.zsk, keys.zskSigner
+		if k.rtype == dns.TypeDNSKEY {
+			key, signer = keys.ksk, keys.kskSigner
+		}
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Name: set[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: set[0].Header().Ttl},
+			Algorithm:  key.Algorithm,
+			KeyTag:     key.KeyTag(),
+			SignerName: zone,
+			Inception:  uint32(now.Add(-sigSkew).Unix()),
+			Expiration: uint32(now.Add(sigValidity).Unix()),
+		}
+		if err := sig.Sign(signer, set); err != nil {
+			continue
+		}
+		out = append(out, sig)
+	}
+	return out
+}
+
+// signResponse 查询带 DO 标志时为应答补充 NSEC 否定证明并在线签名
+func signResponse(r *dns.Msg, msg *dns.Msg, z *zone) {
+	opt := r.IsEdns0()
+	if !dnssecEnabled() || opt == nil || !opt.Do() || msg.Rcode != dns.RcodeSuccess || len(msg.Question) == 0 {
+		return
+	}
+	keys := getZoneKeys(z.name)
+	if keys == nil {
+		return
+	}
+	if len(msg.Answer) == 0 {
+		name := dns.Fqdn(msg.Question[0].Name)
+		msg.Ns = append(msg.Ns, nsecRecord(name, existingTypes(name, z), z.negativeSOA().Hdr.Ttl))
+	}
+	msg.Answer = signSection(msg.Answer, z.name, keys)
+	msg.Ns = signSection(msg.Ns, z.name, keys)
+	msg.Extra = signSection(msg.Extra, z.name, keys)
+}
@@ -0,0 +1,181 @@
+package DnsServer
+
+import (
+	"bflog/config"
+	"bflog/db"
+	"github.com/miekg/dns"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// setupDnssec 使用两个区域的签名配置, 密钥生成到临时目录, 规则表只包含 rules
+func setupDnssec(t *testing.T, rules []db.DnsRule) {
+	t.Helper()
+	cfg := &config.Config{}
+	cfg.Dns.Zones = []config.ZoneConfig{
+		{Name: "dnslog.test", DefaultIp: "192.0.2.10"},
+		// 没有默认地址的区域, 未命中规则的 A 查询是 NODATA
+		{Name: "noip.test"},
+	}
+	cfg.Dns.Dnssec.Enabled = true
+	cfg.Dns.Dnssec.KeyDir = t.TempDir()
+	config.SetBase(cfg)
+	db.SetDB(&db.DBClient{InsertCh: make(chan db.Dnslog, 100)})
+	for _, name := range ZoneNames() {
+		if err := LoadDnssecKeys(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var entries []*ruleEntry
+	for _, rule := range rules {
+		entries = append(entries, &ruleEntry{rule: rule, values: rule.IPAddresses})
+	}
+	ruleTable.Store(newRuleMatcher(entries))
+	t.Cleanup(func() {
+		ruleTable.Store(newRuleMatcher(nil))
+		config.SetBase(nil)
+		db.SetDB(nil)
+	})
+}
+
+func dnssecQuery(t *testing.T, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	r := new(dns.Msg)
+	r.SetQuestion(name, qtype)
+	r.SetEdns0(4096, true)
+	resp := HandleDNSMessage(r, "127.0.0.1:40000", TransportTCP)
+	if resp == nil {
+		t.Fatalf("%s %s: no response", name, dns.TypeToString[qtype])
+	}
+	return resp
+}
+
+// verifySection 用 key 验证段中每个记录集的 RRSIG, 返回验证过的记录类型
+func verifySection(t *testing.T, rrs []dns.RR, key *dns.DNSKEY) map[uint16]bool {
+	t.Helper()
+	sets := make(map[uint16][]dns.RR)
+	var sigs []*dns.RRSIG
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			sigs = append(sigs, sig)
+			continue
+		}
+		sets[rr.Header().Rrtype] = append(sets[rr.Header().Rrtype], rr)
+	}
+	verified := make(map[uint16]bool)
+	for _, sig := range sigs {
+		if err := sig.Verify(key, sets[sig.TypeCovered]); err != nil {
+			t.Errorf("verify RRSIG over %s: %v", dns.TypeToString[sig.TypeCovered], err)
+		}
+		if !sig.ValidityPeriod(time.Now()) {
+			t.Errorf("RRSIG over %s is not valid now", dns.TypeToString[sig.TypeCovered])
+		}
+		verified[sig.TypeCovered] = true
+	}
+	for rtype := range sets {
+		if !verified[rtype] {
+			t.Errorf("%s has no RRSIG", dns.TypeToString[rtype])
+		}
+	}
+	return verified
+}
+
+// zoneKey 取出区域的 DNSKEY, 用 DS 确认 KSK 并验证记录集的签名, 返回 ZSK
+func zoneKey(t *testing.T, zone string) *dns.DNSKEY {
+	t.Helper()
+	resp := dnssecQuery(t, zone, dns.TypeDNSKEY)
+	var ksk, zsk *dns.DNSKEY
+	for _, rr := range resp.Answer {
+		if key, ok := rr.(*dns.DNSKEY); ok {
+			if key.Flags == 257 {
+				ksk = key
+			} else {
+				zsk = key
+			}
+		}
+	}
+	if ksk == nil || zsk == nil {
+		t.Fatalf("%s: DNSKEY answer %v", zone, resp.Answer)
+	}
+	ds, err := DSRecords(zone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 注册商处的 DS 对应应答中的 KSK
+	if got := ksk.ToDS(ds[0].DigestType); got == nil || got.Digest != ds[0].Digest || got.KeyTag != ds[0].KeyTag {
+		t.Fatalf("%s: KSK does not match DS %s", zone, ds[0])
+	}
+	verifySection(t, resp.Answer, ksk)
+	return zsk
+}
+
+func TestSignedNegativeAnswers(t *testing.T) {
+	setupDnssec(t, []db.DnsRule{
+		{ID: 1, Name: "t.dnslog.test", Type: "TXT", IPAddresses: db.DnsRuleValues{"hello"}},
+		{ID: 2, Name: "v6.dnslog.test", Type: "AAAA", IPAddresses: db.DnsRuleValues{"2001:db8::1"}},
+	})
+	tests := []struct {
+		name   string
+		qtype  uint16
+		bitmap []uint16
+	}{
+		{"a.dnslog.test.", dns.TypeAAAA, []uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC}},
+		{"t.dnslog.test.", dns.TypeMX, []uint16{dns.TypeA, dns.TypeTXT, dns.TypeRRSIG, dns.TypeNSEC}},
+		{"v6.dnslog.test.", dns.TypeTXT, []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeRRSIG, dns.TypeNSEC}},
+		{"dnslog.test.", dns.TypeTXT, []uint16{dns.TypeA, dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeDNSKEY}},
+		// 名称服务器只有 glue 地址
+		{"ns1.dnslog.test.", dns.TypeTXT, []uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC}},
+		// 没有默认地址时位图中不能有 A
+		{"a.noip.test.", dns.TypeA, []uint16{dns.TypeRRSIG, dns.TypeNSEC}},
+	}
+	keys := map[string]*dns.DNSKEY{}
+	for _, tt := range tests {
+		t.Run(tt.name+dns.TypeToString[tt.qtype], func(t *testing.T) {
+			zone := findZone(tt.name).name
+			if keys[zone] == nil {
+				keys[zone] = zoneKey(t, zone)
+			}
+			resp := dnssecQuery(t, tt.name, tt.qtype)
+			if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+				t.Fatalf("not a NODATA response: %v", resp)
+			}
+			var nsec *dns.NSEC
+			for _, rr := range resp.Ns {
+				if n, ok := rr.(*dns.NSEC); ok {
+					nsec = n
+				}
+			}
+			if nsec == nil || nsec.Hdr.Name != tt.name {
+				t.Fatalf("no NSEC for %s: %v", tt.name, resp.Ns)
+			}
+			if !reflect.DeepEqual(nsec.TypeBitMap, tt.bitmap) {
+				t.Errorf("bitmap = %v, want %v", typeNames(nsec.TypeBitMap), typeNames(tt.bitmap))
+			}
+			verified := verifySection(t, resp.Ns, keys[zone])
+			if !verified[dns.TypeSOA] || !verified[dns.TypeNSEC] {
+				t.Errorf("verified %v, want SOA and NSEC", verified)
+			}
+		})
+	}
+}
+
+func TestExistingTypesCNAME(t *testing.T) {
+	setupDnssec(t, []db.DnsRule{
+		{ID: 1, Name: "c.dnslog.test", Type: "CNAME", IPAddresses: db.DnsRuleValues{"target.example.org"}},
+		{ID: 2, Name: "c.dnslog.test", Type: "TXT", IPAddresses: db.DnsRuleValues{"ignored"}},
+	})
+	// CNAME 不能与其他类型同时出现在位图中
+	got := nsecRecord("c.dnslog.test.", existingTypes("c.dnslog.test.", findZone("c.dnslog.test.")), 60).TypeBitMap
+	if want := []uint16{dns.TypeCNAME, dns.TypeRRSIG, dns.TypeNSEC}; !reflect.DeepEqual(got, want) {
+		t.Errorf("bitmap = %v, want %v", typeNames(got), typeNames(want))
+	}
+}
+
+func typeNames(types []uint16) []string {
+	var names []string
+	for _, t := range types {
+		names = append(names, dns.TypeToString[t])
+	}
+	return names
+}
@@ -0,0 +1,28 @@
+package DnsServer
+
+import (
+	"bflog/config"
+	"crypto/tls"
+	"github.com/miekg/dns"
+)
+
+// dotServers 按配置创建 DNS over TLS 监听, 未配置监听地址时返回空
+func dotServers() ([]*dns.Server, error) {
+	cfg := config.GetBase().Dns.Dot
+	if len(cfg.Listen) == 0 {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	var servers []*dns.Server
+	for _, addr := range cfg.Listen {
+		servers = append(servers, &dns.Server{Addr: addr, Net: "tcp-tls", TLSConfig: tlsConfig, IdleTimeout: tcpIdleTimeout, Handler: dnsHandler(TransportDoT)})
+	}
+	return servers, nil
+}
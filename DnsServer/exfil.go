@@ -0,0 +1,192 @@
+package DnsServer
+
+import (
+	"bflog/config"
+	"bflog/db"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// exfilPreviewSize 详情接口中文本预览的最大长度
+const exfilPreviewSize = 4096
+
+// ExfilPayload 重组后的外带数据
+type ExfilPayload struct {
+	Token    string `json:"token"`
+	Data     []byte `json:"-"`
+	Size     int    `json:"size"`
+	Chunks   int    `json:"chunks"`
+	Total    int    `json:"total"`
+	Missing  []int  `json:"missing"`
+	Complete bool   `json:"complete"`
+	Preview  string `json:"preview,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// observeExfil 识别符合外带方案的查询并保存分片, name 保留查询中的原始大小写
+func observeExfil(name string, z *zone, client string) {
+	cfg := config.GetBase().Dns.Exfil
+	if !cfg.Enabled || cfg.Scheme == "" {
+		return
+	}
+	chunk, ok := parseExfil(name, removeTrailingDot(z.name), cfg)
+	if !ok {
+		return
+	}
+	chunk.ReceiveIP = client
+	chunk.CreatedTime = time.Now()
+	db.GetDB().InsertExfilChunk(chunk)
+}
+
+// parseExfil 按配置的 label 方案解析区域名之前的 label
+func parseExfil(name string, zone string, cfg config.ExfilConfig) (db.ExfilChunk, bool) {
+	var chunk db.ExfilChunk
+	name = removeTrailingDot(name)
+	if len(name) <= len(zone)+1 || !strings.EqualFold(name[len(name)-len(zone)-1:], "."+zone) {
+		return chunk, false
+	}
+	labels := strings.Split(name[:len(name)-len(zone)-1], ".")
+	scheme := strings.Split(strings.Trim(cfg.Scheme, "."), ".")
+	if len(labels) != len(scheme) {
+		return chunk, false
+	}
+	for i, part := range scheme {
+		label := labels[i]
+		switch part {
+		case "<seq>", "<total>":
+			n, err := strconv.Atoi(label)
+			if err != nil || n < 0 {
+				return chunk, false
+			}
+			if part == "<seq>" {
+				chunk.Seq = n
+			} else {
+				chunk.Total = n
+			}
+		case "<chunk>":
+			if !validExfilChunk(label, cfg.Encoding) {
+				return chunk, false
+			}
+			// 只有 base64url 区分大小写, 其余编码统一为小写便于去重
+			if cfg.Encoding != "base64url" {
+				label = strings.ToLower(label)
+			}
+			chunk.Data = label
+		case "<token>":
+			chunk.Token = strings.ToLower(label)
+		default:
+			if !strings.EqualFold(part, label) {
+				return chunk, false
+			}
+		}
+	}
+	return chunk, chunk.Token != "" && chunk.Data != ""
+}
+
+// validExfilChunk 检查 label 是否只包含编码允许的字符
+func validExfilChunk(label string, encoding string) bool {
+	for _, c := range label {
+		ok := false
+		switch encoding {
+		case "base32":
+			ok = (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '2' && c <= '7')
+		case "base64url":
+			ok = (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '_'
+		default:
+			ok = (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+		}
+		if !ok {
+			return false
+		}
+	}
+	return label != ""
+}
+
+// decodeExfil 解码按序拼接后的数据, 分片不一定落在编码块的边界上所以整体解码.
+// base64url 区分大小写, 解析器开启 0x20 大小写随机化时收到的 label 大小写会被打乱,
+// 只有经过保留大小写的解析器时才能正确解码; hex 和 base32 不受影响
+func decodeExfil(data string, encoding string) ([]byte, error) {
+	switch encoding {
+	case "base32":
+		return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(data))
+	case "base64url":
+		return base64.RawURLEncoding.DecodeString(data)
+	case "", "hex":
+		return hex.DecodeString(data)
+	}
+	return nil, fmt.Errorf("unsupported exfil encoding: %s", encoding)
+}
+
+// exfilRange 返回会话预期的分片序号范围
+func exfilRange(maxSeq int, total int) (int, int) {
+	start := config.GetBase().Dns.Exfil.SeqStart
+	if total > 0 {
+		return start, start + total - 1
+	}
+	return start, maxSeq
+}
+
+// ExfilComplete 判断会话的分片是否已经收齐
+func ExfilComplete(session db.ExfilSession) bool {
+	start, end := exfilRange(session.MaxSeq, session.Total)
+	return session.MinSeq >= start && session.MaxSeq <= end && session.Chunks == end-start+1
+}
+
+// ReassembleExfil 按序号重组某个 token 的全部分片
+func ReassembleExfil(token string) (*ExfilPayload, error) {
+	chunks, err := db.GetDB().GetExfilChunks(strings.ToLower(token))
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) == 0 {
+		return nil, fmt.Errorf("exfil session %s not found", token)
+	}
+	return reassembleExfil(token, chunks, config.GetBase().Dns.Exfil.Encoding), nil
+}
+
+// reassembleExfil 按序号拼接分片并解码, 同一序号出现多次时只使用最先收到的一个
+func reassembleExfil(token string, chunks []db.ExfilChunk, encoding string) *ExfilPayload {
+	sort.SliceStable(chunks, func(i, j int) bool { return chunks[i].Seq < chunks[j].Seq })
+	payload := &ExfilPayload{Token: token}
+	received := make(map[int]bool, len(chunks))
+	var data strings.Builder
+	for _, chunk := range chunks {
+		if received[chunk.Seq] {
+			continue
+		}
+		received[chunk.Seq] = true
+		payload.Chunks++
+		data.WriteString(chunk.Data)
+		if chunk.Total > payload.Total {
+			payload.Total = chunk.Total
+		}
+	}
+	start, end := exfilRange(chunks[len(chunks)-1].Seq, payload.Total)
+	for seq := start; seq <= end; seq++ {
+		if !received[seq] {
+			payload.Missing = append(payload.Missing, seq)
+		}
+	}
+	payload.Complete = len(payload.Missing) == 0
+	var err error
+	payload.Data, err = decodeExfil(data.String(), encoding)
+	if err != nil {
+		payload.Error = err.Error()
+	}
+	payload.Size = len(payload.Data)
+	if utf8.Valid(payload.Data) {
+		preview := payload.Data
+		if len(preview) > exfilPreviewSize {
+			preview = preview[:exfilPreviewSize]
+		}
+		payload.Preview = string(preview)
+	}
+	return payload
+}
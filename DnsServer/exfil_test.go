@@ -0,0 +1,131 @@
+package DnsServer
+
+import (
+	"bflog/config"
+	"bflog/db"
+	"encoding/base32"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseExfil(t *testing.T) {
+	tests := []struct {
+		name   string
+		qname  string
+		scheme string
+		enc    string
+		ok     bool
+		want   db.ExfilChunk
+	}{
+		{"hex", "0.6869.abc123.dnslog.test.", "<seq>.<chunk>.<token>", "hex", true,
+			db.ExfilChunk{Token: "abc123", Seq: 0, Data: "6869"}},
+		// 0x20 大小写随机化后 hex/base32 的分片和 token 统一为小写, 重复查询得到相同的分片
+		{"hex mixed case", "0.6B69.AbC123.DnsLog.Test", "<seq>.<chunk>.<token>", "hex", true,
+			db.ExfilChunk{Token: "abc123", Seq: 0, Data: "6b69"}},
+		{"base32", "NBUQ.2.x.t1.dnslog.test", "<chunk>.<seq>.x.<token>", "base32", true,
+			db.ExfilChunk{Token: "t1", Seq: 2, Data: "nbuq"}},
+		// base64url 保留大小写
+		{"base64url", "1.aGk-_Q.T1.3.dnslog.test", "<seq>.<chunk>.<token>.<total>", "base64url", true,
+			db.ExfilChunk{Token: "t1", Seq: 1, Total: 3, Data: "aGk-_Q"}},
+		{"other zone", "0.6869.abc123.example.test", "<seq>.<chunk>.<token>", "hex", false, db.ExfilChunk{}},
+		{"zone only", "dnslog.test", "<seq>.<chunk>.<token>", "hex", false, db.ExfilChunk{}},
+		{"label count", "6869.abc123.dnslog.test", "<seq>.<chunk>.<token>", "hex", false, db.ExfilChunk{}},
+		{"literal", "0.6869.y.t1.dnslog.test", "<seq>.<chunk>.x.<token>", "hex", false, db.ExfilChunk{}},
+		{"bad seq", "a.6869.abc123.dnslog.test", "<seq>.<chunk>.<token>", "hex", false, db.ExfilChunk{}},
+		{"bad chunk", "0.zz.abc123.dnslog.test", "<seq>.<chunk>.<token>", "hex", false, db.ExfilChunk{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.ExfilConfig{Enabled: true, Scheme: tt.scheme, Encoding: tt.enc}
+			chunk, ok := parseExfil(tt.qname, "dnslog.test", cfg)
+			if ok != tt.ok {
+				t.Fatalf("ok = %t, want %t", ok, tt.ok)
+			}
+			if ok && chunk != tt.want {
+				t.Errorf("chunk = %+v, want %+v", chunk, tt.want)
+			}
+		})
+	}
+}
+
+// exfilChunks 把数据按 size 个字符切成从 start 开始编号的分片
+func exfilChunks(token string, data string, size int, start int) []db.ExfilChunk {
+	var chunks []db.ExfilChunk
+	for i := 0; len(data) > 0; i++ {
+		n := size
+		if n > len(data) {
+			n = len(data)
+		}
+		chunks = append(chunks, db.ExfilChunk{Token: token, Seq: start + i, Data: data[:n]})
+		data = data[n:]
+	}
+	return chunks
+}
+
+func TestReassembleExfil(t *testing.T) {
+	cfg := &config.Config{}
+	config.SetBase(cfg)
+	t.Cleanup(func() { config.SetBase(nil) })
+
+	secret := "uid=0(root) gid=0(root) groups=0(root)"
+	hexChunks := exfilChunks("abc", hex.EncodeToString([]byte(secret)), 10, 0)
+	b32 := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte(secret)))
+
+	t.Run("complete", func(t *testing.T) {
+		// 乱序并带重复的分片, 重复的分片只使用一次
+		chunks := append([]db.ExfilChunk{}, hexChunks...)
+		chunks[0], chunks[3] = chunks[3], chunks[0]
+		chunks = append(chunks, hexChunks[1], hexChunks[5])
+		payload := reassembleExfil("abc", chunks, "hex")
+		if string(payload.Data) != secret || payload.Preview != secret {
+			t.Errorf("data = %q", payload.Data)
+		}
+		if !payload.Complete || payload.Chunks != len(hexChunks) || payload.Missing != nil || payload.Error != "" {
+			t.Errorf("payload = %+v", payload)
+		}
+	})
+
+	t.Run("duplicate keeps first", func(t *testing.T) {
+		dup := hexChunks[1]
+		dup.Data = "ffffffffff"
+		chunks := append([]db.ExfilChunk{}, hexChunks...)
+		chunks = append(chunks, dup)
+		if payload := reassembleExfil("abc", chunks, "hex"); string(payload.Data) != secret {
+			t.Errorf("data = %q", payload.Data)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		chunks := exfilChunks("t", b32, 8, 1)
+		for i := range chunks {
+			chunks[i].Total = len(chunks) + 1
+		}
+		chunks = append(chunks[:2], chunks[3:]...)
+		payload := reassembleExfil("t", chunks, "base32")
+		if payload.Complete || !reflect.DeepEqual(payload.Missing, []int{0, 3}) {
+			t.Errorf("complete = %t, missing = %v", payload.Complete, payload.Missing)
+		}
+	})
+
+	t.Run("seq start", func(t *testing.T) {
+		cfg.Dns.Exfil.SeqStart = 1
+		defer func() { cfg.Dns.Exfil.SeqStart = 0 }()
+		payload := reassembleExfil("t", exfilChunks("t", b32, 8, 1), "base32")
+		if !payload.Complete || string(payload.Data) != secret {
+			t.Errorf("payload = %+v", payload)
+		}
+	})
+
+	t.Run("decode error", func(t *testing.T) {
+		payload := reassembleExfil("abc", hexChunks[:1], "hex")
+		if payload.Error != "" {
+			t.Fatalf("unexpected error %s", payload.Error)
+		}
+		payload = reassembleExfil("abc", []db.ExfilChunk{{Seq: 0, Data: "abc"}}, "hex")
+		if payload.Error == "" {
+			t.Error("odd-length hex decoded without error")
+		}
+	})
+}
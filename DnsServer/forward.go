@@ -0,0 +1,379 @@
+package DnsServer
+
+import (
+	"bflog/config"
+	"bflog/db"
+	"bflog/utils"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultForwardTimeout   = 2 * time.Second
+	defaultForwardCacheSize = 10000
+	// defaultForwardConcurrency 同时等待上游应答的查询数上限
+	defaultForwardConcurrency = 256
+	// forwardNegativeTTL 否定应答中没有 SOA 时的缓存时间
+	forwardNegativeTTL = 60
+)
+
+// ForwardStats 转发和缓存的统计
+type ForwardStats struct {
+	Enabled   bool  `json:"enabled"`
+	Forwarded int64 `json:"forwarded"`
+	CacheHits int64 `json:"cache_hits"`
+	Failed    int64 `json:"failed"`
+	Refused   int64 `json:"refused"`
+	// Dropped 等待上游的查询数达到 concurrency 时丢弃的查询
+	Dropped int64 `json:"dropped"`
+	Cached  int   `json:"cached"`
+}
+
+// forwardCacheEntry 缓存的上游应答, 取出时按经过的时间减少 TTL
+type forwardCacheEntry struct {
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+// forwardCache 以 (查询名, 类型, 类别, DO) 为 key 的应答缓存
+type forwardCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*forwardCacheEntry
+}
+
+var (
+	forwardCacheMu sync.Mutex
+	fwdCache       *forwardCache
+	fwdForwarded   atomic.Int64
+	fwdCacheHits   atomic.Int64
+	fwdFailed      atomic.Int64
+	fwdRefused     atomic.Int64
+	fwdDropped     atomic.Int64
+	fwdSlots       chan struct{}
+)
+
+func newForwardCache(size int) *forwardCache {
+	return &forwardCache{size: size, entries: make(map[string]*forwardCacheEntry)}
+}
+
+func forwardCacheKey(r *dns.Msg) string {
+	q := r.Question[0]
+	do := false
+	if opt := r.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	return fmt.Sprintf("%s|%d|%d|%t", strings.ToLower(q.Name), q.Qtype, q.Qclass, do)
+}
+
+// get 返回缓存的应答副本, TTL 已经减去在缓存中停留的时间
+func (c *forwardCache) get(key string, now time.Time) *dns.Msg {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok && !now.Before(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	msg := entry.msg.Copy()
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if rr.Header().Ttl > elapsed {
+				rr.Header().Ttl -= elapsed
+			} else {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+	return msg
+}
+
+// put 按应答中最小的 TTL 缓存, 否定应答使用 SOA 的否定缓存时间. 缓存满时先清理过期的记录
+func (c *forwardCache) put(key string, msg *dns.Msg, now time.Time) {
+	ttl, ok := cacheTTL(msg)
+	if !ok || ttl == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.size {
+		for k, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		// 仍然是满的时候随机淘汰一条
+		for k := range c.entries {
+			if len(c.entries) < c.size {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = &forwardCacheEntry{msg: msg.Copy(), stored: now, expires: now.Add(time.Duration(ttl) * time.Second)}
+}
+
+func (c *forwardCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// cacheTTL 计算应答可以缓存的时间, 只缓存 NOERROR 和 NXDOMAIN
+func cacheTTL(msg *dns.Msg) (uint32, bool) {
+	if msg.Truncated || (msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError) {
+		return 0, false
+	}
+	if len(msg.Answer) > 0 && msg.Rcode == dns.RcodeSuccess {
+		ttl := msg.Answer[0].Header().Ttl
+		for _, rr := range msg.Answer[1:] {
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+		return ttl, true
+	}
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			return ttl, true
+		}
+	}
+	return forwardNegativeTTL, true
+}
+
+func forwardEnabled() bool {
+	cfg := config.GetBase().Dns.Forward
+	return cfg.Enabled && len(cfg.Upstreams) > 0
+}
+
+// forwardQuery 开启转发时, 只有一个问题并且不属于任何区域的查询交给上游
+func forwardQuery(r *dns.Msg) bool {
+	return forwardEnabled() && len(r.Question) == 1 && findZone(r.Question[0].Name) == nil
+}
+
+// getForwardSlots 按配置的 concurrency 懒加载限制并发的信号量
+func getForwardSlots() chan struct{} {
+	size := config.GetBase().Dns.Forward.Concurrency
+	if size <= 0 {
+		size = defaultForwardConcurrency
+	}
+	forwardCacheMu.Lock()
+	defer forwardCacheMu.Unlock()
+	if fwdSlots == nil || cap(fwdSlots) != size {
+		fwdSlots = make(chan struct{}, size)
+	}
+	return fwdSlots
+}
+
+// forwardAsync 在单独的协程中转发查询并发送应答, 慢的上游不会占满处理权威应答的 worker.
+// 等待上游的查询达到 concurrency 时直接丢弃, 由客户端重试
+func forwardAsync(w dns.ResponseWriter, r *dns.Msg, transport string) {
+	slots := getForwardSlots()
+	select {
+	case slots <- struct{}{}:
+	default:
+		fwdDropped.Add(1)
+		return
+	}
+	if !beginQuery() {
+		<-slots
+		return
+	}
+	go func() {
+		defer func() {
+			<-slots
+			inflight.Done()
+		}()
+		receiveIP := w.RemoteAddr().String()
+		if msg := forwardMessage(r, receiveIP, clientAddr(receiveIP), transport); msg != nil {
+			w.WriteMsg(msg)
+		}
+	}()
+}
+
+// getForwardCache 按配置的大小懒加载缓存, cache_size 为负数时不缓存
+func getForwardCache() *forwardCache {
+	size := config.GetBase().Dns.Forward.CacheSize
+	if size < 0 {
+		return nil
+	}
+	if size == 0 {
+		size = defaultForwardCacheSize
+	}
+	forwardCacheMu.Lock()
+	defer forwardCacheMu.Unlock()
+	if fwdCache == nil || fwdCache.size != size {
+		fwdCache = newForwardCache(size)
+	}
+	return fwdCache
+}
+
+// forwardAllowed 来源是否在 allow_from 中, allow_from 为空时不限制
+func forwardAllowed(clientIP string) bool {
+	allow := config.GetBase().Dns.Forward.AllowFrom
+	if len(allow) == 0 {
+		return true
+	}
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return false
+	}
+	// 加载配置时已经校验过, 出错时拒绝而不是放行
+	nets, err := utils.ParseCidrs(allow...)
+	if err != nil {
+		return false
+	}
+	for _, network := range nets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func upstreamAddr(upstream string) string {
+	if _, _, err := net.SplitHostPort(upstream); err == nil {
+		return upstream
+	}
+	return net.JoinHostPort(upstream, "53")
+}
+
+// exchangeUpstream 按顺序查询上游, UDP 应答被截断时改用 TCP 重试
+func exchangeUpstream(r *dns.Msg) (*dns.Msg, string, error) {
+	cfg := config.GetBase().Dns.Forward
+	timeout := defaultForwardTimeout
+	if cfg.Timeout > 0 {
+		timeout = time.Duration(cfg.Timeout) * time.Millisecond
+	}
+	query := r.Copy()
+	query.RecursionDesired = true
+	var lastErr error
+	for _, upstream := range cfg.Upstreams {
+		addr := upstreamAddr(upstream)
+		client := &dns.Client{Net: "udp", Timeout: timeout}
+		resp, _, err := client.Exchange(query, addr)
+		if err == nil && resp.Truncated {
+			client.Net = "tcp"
+			resp, _, err = client.Exchange(query, addr)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return resp, addr, nil
+	}
+	return nil, "", lastErr
+}
+
+// forwardMessage 把区域外的查询转发到上游, 结果单独记录到 forward_log.
+// UDP 应答和权威应答一样经过 RRL, 被限速丢弃时返回 nil
+func forwardMessage(r *dns.Msg, receiveIP string, clientIP string, transport string) *dns.Msg {
+	q := r.Question[0]
+	record := db.ForwardLog{
+		ReceiveIP:   receiveIP,
+		QueryName:   strings.ToLower(removeTrailingDot(q.Name)),
+		QueryType:   dns.TypeToString[q.Qtype],
+		Transport:   transport,
+		CreatedTime: time.Now(),
+	}
+	var resp *dns.Msg
+	if !forwardAllowed(clientIP) {
+		fwdRefused.Add(1)
+		resp = new(dns.Msg)
+		resp.SetRcode(r, dns.RcodeRefused)
+	} else {
+		cache := getForwardCache()
+		key := forwardCacheKey(r)
+		now := time.Now()
+		if cache != nil {
+			resp = cache.get(key, now)
+		}
+		if resp != nil {
+			fwdCacheHits.Add(1)
+			record.Cached = true
+		} else {
+			upstreamResp, upstream, err := exchangeUpstream(r)
+			record.Duration = int(time.Since(now) / time.Millisecond)
+			record.Upstream = upstream
+			if err != nil {
+				fwdFailed.Add(1)
+				resp = new(dns.Msg)
+				resp.SetRcode(r, dns.RcodeServerFailure)
+			} else {
+				fwdForwarded.Add(1)
+				resp = upstreamResp
+				if cache != nil {
+					cache.put(key, resp, now)
+				}
+			}
+		}
+	}
+	resp.Id = r.Id
+	resp.Authoritative = false
+	resp.RecursionAvailable = true
+	if transport == TransportUDP {
+		size := dns.MinMsgSize
+		if opt := r.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+		resp.Truncate(size)
+	}
+	record.Rcode = dns.RcodeToString[resp.Rcode]
+	record.Answer = answerText(resp)
+	logged := true
+	// 开放解析器容易被用来做反射放大, 对 UDP 应答限速
+	if transport == TransportUDP {
+		switch rrlCheck(clientIP, resp) {
+		case rrlDrop:
+			resp = nil
+			record.Answer += "\n(RRL drop)"
+			logged = rrlShouldLog()
+		case rrlSlip:
+			resp = slipReply(r)
+			resp.Authoritative = false
+			resp.RecursionAvailable = true
+			record.Answer += "\n(RRL slip)"
+			logged = rrlShouldLog()
+		}
+	}
+	if logged {
+		db.GetDB().InsertForwardLog(record)
+	}
+	return resp
+}
+
+// GetForwardStats 返回转发统计
+func GetForwardStats() ForwardStats {
+	stats := ForwardStats{
+		Enabled:   forwardEnabled(),
+		Forwarded: fwdForwarded.Load(),
+		CacheHits: fwdCacheHits.Load(),
+		Failed:    fwdFailed.Load(),
+		Refused:   fwdRefused.Load(),
+		Dropped:   fwdDropped.Load(),
+	}
+	forwardCacheMu.Lock()
+	cache := fwdCache
+	forwardCacheMu.Unlock()
+	if cache != nil {
+		stats.Cached = cache.len()
+	}
+	return stats
+}
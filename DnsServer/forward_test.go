@@ -0,0 +1,169 @@
+package DnsServer
+
+import (
+	"bflog/config"
+	"bflog/db"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startUpstream 在 127.0.0.1 上启动一个 UDP 上游, A 查询都返回 192.0.2.1, 返回地址和收到的查询数
+func startUpstream(t *testing.T) (string, *atomic.Int64) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := new(atomic.Int64)
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        pc,
+		NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			queries.Add(1)
+			msg := new(dns.Msg)
+			msg.SetReply(r)
+			msg.Answer = append(msg.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.ParseIP("192.0.2.1").To4(),
+			})
+			w.WriteMsg(msg)
+		}),
+	}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return pc.LocalAddr().String(), queries
+}
+
+// setupForward 使用只包含转发配置的 config 和只带通道的 DBClient, 返回转发记录的通道
+func setupForward(t *testing.T, upstream string) chan db.ForwardLog {
+	t.Helper()
+	cfg := &config.Config{}
+	cfg.Server.Subdomain = "dnslog.test"
+	cfg.Dns.Forward = config.ForwardConfig{Enabled: true, Upstreams: []string{upstream}, Timeout: 1000}
+	config.SetBase(cfg)
+	ch := make(chan db.ForwardLog, 10)
+	db.SetDB(&db.DBClient{ForwardCh: ch})
+	forwardCacheMu.Lock()
+	fwdCache = nil
+	forwardCacheMu.Unlock()
+	t.Cleanup(func() {
+		config.SetBase(nil)
+		db.SetDB(nil)
+	})
+	return ch
+}
+
+func forwardRecord(t *testing.T, ch chan db.ForwardLog) db.ForwardLog {
+	t.Helper()
+	select {
+	case record := <-ch:
+		return record
+	default:
+		t.Fatal("no forward_log record")
+	}
+	return db.ForwardLog{}
+}
+
+func TestForwardCache(t *testing.T) {
+	upstream, queries := startUpstream(t)
+	ch := setupForward(t, upstream)
+
+	r := new(dns.Msg)
+	r.SetQuestion("www.Example.org.", dns.TypeA)
+	for i, cached := range []bool{false, true} {
+		resp := HandleDNSMessage(r, "127.0.0.1:40000", TransportTCP)
+		if resp == nil || len(resp.Answer) != 1 {
+			t.Fatalf("query %d: unexpected response %v", i, resp)
+		}
+		if a := resp.Answer[0].(*dns.A); !a.A.Equal(net.ParseIP("192.0.2.1")) {
+			t.Errorf("query %d: answer %s", i, a.A)
+		}
+		if resp.Authoritative || !resp.RecursionAvailable {
+			t.Errorf("query %d: aa=%t ra=%t", i, resp.Authoritative, resp.RecursionAvailable)
+		}
+		record := forwardRecord(t, ch)
+		if record.Cached != cached {
+			t.Errorf("query %d: cached = %t, want %t", i, record.Cached, cached)
+		}
+		if record.QueryName != "www.example.org" || record.QueryType != "A" || record.Rcode != "NOERROR" {
+			t.Errorf("query %d: record %+v", i, record)
+		}
+		if !cached && record.Upstream != upstream {
+			t.Errorf("query %d: upstream = %q, want %q", i, record.Upstream, upstream)
+		}
+		if cached && record.Upstream != "" {
+			t.Errorf("query %d: cached record has upstream %q", i, record.Upstream)
+		}
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("upstream received %d queries, want 1", n)
+	}
+}
+
+func TestForwardRefused(t *testing.T) {
+	upstream, queries := startUpstream(t)
+	ch := setupForward(t, upstream)
+	config.GetBase().Dns.Forward.AllowFrom = []string{"10.0.0.0/8"}
+
+	r := new(dns.Msg)
+	r.SetQuestion("www.example.org.", dns.TypeA)
+	resp := HandleDNSMessage(r, "127.0.0.1:40000", TransportTCP)
+	if resp == nil || resp.Rcode != dns.RcodeRefused {
+		t.Fatalf("unexpected response %v", resp)
+	}
+	if record := forwardRecord(t, ch); record.Rcode != "REFUSED" {
+		t.Errorf("record rcode = %s", record.Rcode)
+	}
+	if n := queries.Load(); n != 0 {
+		t.Errorf("upstream received %d queries, want 0", n)
+	}
+}
+
+func TestForwardRRL(t *testing.T) {
+	upstream, _ := startUpstream(t)
+	ch := setupForward(t, upstream)
+	config.GetBase().Dns.Rrl = config.RrlConfig{Enabled: true, ResponsesPerSecond: 1, Window: 15}
+
+	// 每次使用新的查询名, 计数桶不受之前的测试影响
+	r := new(dns.Msg)
+	r.SetQuestion(fmt.Sprintf("rrl%d.example.org.", time.Now().UnixNano()), dns.TypeA)
+	if resp := HandleDNSMessage(r, "127.0.0.1:40000", TransportUDP); resp == nil {
+		t.Fatal("first query dropped")
+	}
+	forwardRecord(t, ch)
+	if resp := HandleDNSMessage(r, "127.0.0.1:40000", TransportUDP); resp != nil {
+		t.Fatalf("second query not limited: %v", resp)
+	}
+	// log_sample 为 0 时被限速的查询也记录
+	if record := forwardRecord(t, ch); !strings.HasSuffix(record.Answer, "(RRL drop)") {
+		t.Errorf("record answer = %q", record.Answer)
+	}
+}
+
+func TestForwardAllowed(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Dns.Forward.AllowFrom = []string{"10.0.0.0/8", "192.0.2.7", "2001:db8::1, 2001:db8:1::/48"}
+	config.SetBase(cfg)
+	t.Cleanup(func() { config.SetBase(nil) })
+	tests := map[string]bool{
+		"10.1.2.3":      true,
+		"192.0.2.7":     true,
+		"192.0.2.8":     false,
+		"2001:db8::1":   true,
+		"2001:db8::2":   false,
+		"2001:db8:1::5": true,
+		"bad":           false,
+	}
+	for ip, want := range tests {
+		if got := forwardAllowed(ip); got != want {
+			t.Errorf("forwardAllowed(%s) = %t, want %t", ip, got, want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package DnsServer
+
+import (
+	"bflog/db"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	MatchExact    = "exact"
+	MatchWildcard = "wildcard"
+	MatchRegex    = "regex"
+)
+
+// ruleMatcher 规则匹配引擎, 优先级依次为: 精确匹配, 最长的通配符, 按 Priority 排序的正则
+type ruleMatcher struct {
+	exact    map[string]*ruleEntry
+	wildcard map[string]*ruleEntry // key 为去掉 "*." 后的后缀与记录类型
+	regex    []*ruleEntry
+}
+
+// RuleMatchType 返回规则实际使用的匹配方式
+func RuleMatchType(rule db.DnsRule) string {
+	switch strings.ToLower(rule.MatchType) {
+	case MatchWildcard:
+		return MatchWildcard
+	case MatchRegex:
+		return MatchRegex
+	case MatchExact:
+		return MatchExact
+	}
+	if strings.HasPrefix(rule.Name, "*.") {
+		return MatchWildcard
+	}
+	return MatchExact
+}
+
+// ValidateRulePattern 校验规则名称与匹配方式是否一致
+func ValidateRulePattern(rule db.DnsRule) error {
+	switch strings.ToLower(rule.MatchType) {
+	case "", MatchExact, MatchWildcard, MatchRegex:
+	default:
+		return fmt.Errorf("不支持的匹配方式: %s", rule.MatchType)
+	}
+	switch RuleMatchType(rule) {
+	case MatchWildcard:
+		if !strings.HasPrefix(rule.Name, "*.") || len(rule.Name) < 3 {
+			return fmt.Errorf("通配符规则必须以 *. 开头: %s", rule.Name)
+		}
+	case MatchRegex:
+		if _, err := regexp.Compile(rule.Name); err != nil {
+			return fmt.Errorf("正则表达式错误: %v", err)
+		}
+	}
+	return nil
+}
+
+func newRuleMatcher(entries []*ruleEntry) *ruleMatcher {
+	m := &ruleMatcher{
+		exact:    make(map[string]*ruleEntry),
+		wildcard: make(map[string]*ruleEntry),
+	}
+	for _, entry := range entries {
+		name := strings.ToLower(strings.TrimSuffix(entry.rule.Name, "."))
+		switch RuleMatchType(entry.rule) {
+		case MatchWildcard:
+			m.wildcard[db.DnsRuleKey(strings.TrimPrefix(name, "*."), entry.rule.Type)] = entry
+		case MatchRegex:
+			re, err := regexp.Compile(entry.rule.Name)
+			if err != nil {
+				continue
+			}
+			entry.re = re
+			m.regex = append(m.regex, entry)
+		default:
+			m.exact[db.DnsRuleKey(name, entry.rule.Type)] = entry
+		}
+	}
+	sort.SliceStable(m.regex, func(i, j int) bool {
+		if m.regex[i].rule.Priority != m.regex[j].rule.Priority {
+			return m.regex[i].rule.Priority < m.regex[j].rule.Priority
+		}
+		return m.regex[i].rule.ID < m.regex[j].rule.ID
+	})
+	return m
+}
+
+// match 查找域名对应类型的规则, domain 需为小写且不带末尾的点
+func (m *ruleMatcher) match(domain string, rtype string) *ruleEntry {
+	if entry, ok := m.exact[db.DnsRuleKey(domain, rtype)]; ok {
+		return entry
+	}
+	// 从最长的后缀开始逐级去掉最左边的 label, 第一个命中的就是最长的通配符
+	for suffix := domain; ; {
+		i := strings.IndexByte(suffix, '.')
+		if i < 0 {
+			break
+		}
+		suffix = suffix[i+1:]
+		if entry, ok := m.wildcard[db.DnsRuleKey(suffix, rtype)]; ok {
+			return entry
+		}
+	}
+	for _, entry := range m.regex {
+		if entry.rule.Type == rtype && entry.re.MatchString(domain) {
+			return entry
+		}
+	}
+	return nil
+}
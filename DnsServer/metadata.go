@@ -0,0 +1,75 @@
+package DnsServer
+
+import (
+	"bflog/db"
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+	"time"
+)
+
+// newDnslog 从查询报文中提取记录到 dnslog 的元数据
+func newDnslog(r *dns.Msg, q dns.Question, receiveIP string, transport string) db.Dnslog {
+	record := db.Dnslog{
+		ReceiveIP:        receiveIP,
+		QueryName:        strings.ToLower(removeTrailingDot(q.Name)),
+		RawName:          removeTrailingDot(q.Name),
+		QueryType:        dns.TypeToString[q.Qtype],
+		QueryClass:       dns.ClassToString[q.Qclass],
+		TransactionID:    int(r.Id),
+		RecursionDesired: r.RecursionDesired,
+		CheckingDisabled: r.CheckingDisabled,
+		Transport:        transport,
+		CreatedTime:      time.Now(),
+	}
+	if opt := r.IsEdns0(); opt != nil {
+		record.DnssecOK = opt.Do()
+		record.EdnsSize = int(opt.UDPSize())
+		for _, option := range opt.Option {
+			if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+				record.ClientSubnet = fmt.Sprintf("%s/%d", subnet.Address, subnet.SourceNetmask)
+			}
+		}
+	}
+	return record
+}
+
+// responseTTL 应答中记录的最小 TTL, 没有应答记录时取否定应答中 SOA 的 TTL
+func responseTTL(msg *dns.Msg) uint32 {
+	if len(msg.Answer) > 0 {
+		ttl := msg.Answer[0].Header().Ttl
+		for _, rr := range msg.Answer[1:] {
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+		return ttl
+	}
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Hdr.Ttl
+		}
+	}
+	return 0
+}
+
+// answerText 把实际返回的应答转成文本, 没有应答记录时返回响应码
+func answerText(msg *dns.Msg) string {
+	var text string
+	if len(msg.Answer) == 0 {
+		text = dns.RcodeToString[msg.Rcode]
+		if msg.Rcode == dns.RcodeSuccess {
+			text = "NODATA"
+		}
+	} else {
+		lines := make([]string, 0, len(msg.Answer))
+		for _, rr := range msg.Answer {
+			lines = append(lines, rr.String())
+		}
+		text = strings.Join(lines, "\n")
+	}
+	if msg.Truncated {
+		text += "\n(TC)"
+	}
+	return text
+}
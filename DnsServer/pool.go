@@ -0,0 +1,104 @@
+package DnsServer
+
+import (
+	"bflog/config"
+	"github.com/miekg/dns"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// dnsJob 等待处理的一条查询
+type dnsJob struct {
+	w         dns.ResponseWriter
+	r         *dns.Msg
+	transport string
+}
+
+// PoolStats 查询处理协程池的统计
+type PoolStats struct {
+	Workers  int   `json:"workers"`
+	QueueLen int   `json:"queue_len"`
+	QueueCap int   `json:"queue_cap"`
+	Handled  int64 `json:"handled"`
+	Dropped  int64 `json:"dropped"`
+}
+
+var (
+	jobCh       chan dnsJob
+	poolWorkers int
+	poolHandled atomic.Int64
+	poolDropped atomic.Int64
+
+	// stopMu 保护 stopped, inflight 为排队和正在处理的查询(包括转发和 DoH), Stop 等待它们写完日志
+	stopMu   sync.RWMutex
+	stopped  bool
+	inflight sync.WaitGroup
+)
+
+// beginQuery 登记一条要处理的查询, Stop 之后返回 false, 查询直接丢弃. 处理完后调用 inflight.Done
+func beginQuery() bool {
+	stopMu.RLock()
+	defer stopMu.RUnlock()
+	if stopped {
+		return false
+	}
+	inflight.Add(1)
+	return true
+}
+
+// Stop 停止接收新的查询并等待已经接收的查询处理完, 之后才能关闭 dnslog/exfil/forward 的写库通道
+func Stop() {
+	stopMu.Lock()
+	stopped = true
+	stopMu.Unlock()
+	inflight.Wait()
+}
+
+// startWorkers 启动固定数量的处理协程, 避免查询洪水时协程无限增长
+func startWorkers() {
+	poolWorkers = config.GetBase().Dns.Workers
+	if poolWorkers <= 0 {
+		poolWorkers = runtime.NumCPU() * 8
+	}
+	queue := config.GetBase().Dns.Queue
+	if queue <= 0 {
+		queue = 4096
+	}
+	jobCh = make(chan dnsJob, queue)
+	for i := 0; i < poolWorkers; i++ {
+		go func() {
+			for job := range jobCh {
+				handleDNSRequest(job.w, job.r, job.transport)
+				poolHandled.Add(1)
+				inflight.Done()
+			}
+		}()
+	}
+}
+
+// dnsHandler 返回绑定了传输方式的 handler, 查询交给协程池处理, 队列满时直接丢弃
+func dnsHandler(transport string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		if !beginQuery() {
+			return
+		}
+		select {
+		case jobCh <- dnsJob{w: w, r: r, transport: transport}:
+		default:
+			poolDropped.Add(1)
+			inflight.Done()
+		}
+	}
+}
+
+// GetPoolStats 返回协程池的统计
+func GetPoolStats() PoolStats {
+	return PoolStats{
+		Workers:  poolWorkers,
+		QueueLen: len(jobCh),
+		QueueCap: cap(jobCh),
+		Handled:  poolHandled.Load(),
+		Dropped:  poolDropped.Load(),
+	}
+}
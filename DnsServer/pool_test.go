@@ -0,0 +1,72 @@
+package DnsServer
+
+import (
+	"github.com/miekg/dns"
+	"testing"
+	"time"
+)
+
+func TestStopWaitsForInflight(t *testing.T) {
+	t.Cleanup(func() {
+		stopMu.Lock()
+		stopped = false
+		stopMu.Unlock()
+	})
+	if !beginQuery() {
+		t.Fatal("beginQuery before Stop = false")
+	}
+	done := make(chan struct{})
+	go func() {
+		Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Stop returned while a query is in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	inflight.Done()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Stop did not return after the query finished")
+	}
+
+	// 停止之后不再处理新的查询
+	if beginQuery() {
+		t.Error("beginQuery after Stop = true")
+	}
+	r := new(dns.Msg)
+	r.SetQuestion("a.dnslog.test.", dns.TypeA)
+	if msg := HandleDNSMessage(r, "192.0.2.1:53", TransportDoH); msg != nil {
+		t.Errorf("HandleDNSMessage after Stop = %v", msg)
+	}
+}
+
+func TestDnsHandlerQueueFull(t *testing.T) {
+	// 不启动处理协程, 队列满后的查询直接丢弃
+	jobCh = make(chan dnsJob, 2)
+	t.Cleanup(func() { jobCh = nil })
+	dropped := poolDropped.Load()
+	handler := dnsHandler(TransportUDP)
+	for i := 0; i < 3; i++ {
+		r := new(dns.Msg)
+		r.SetQuestion("a.dnslog.test.", dns.TypeA)
+		r.Id = uint16(i)
+		handler(nil, r)
+	}
+	if n := poolDropped.Load() - dropped; n != 1 {
+		t.Errorf("dropped = %d, want 1", n)
+	}
+	// 先到的查询留在队列中, 每条都登记为 in flight
+	for i := 0; i < 2; i++ {
+		job := <-jobCh
+		if job.r.Id != uint16(i) || job.transport != TransportUDP {
+			t.Errorf("job %d: id = %d, transport = %s", i, job.r.Id, job.transport)
+		}
+		inflight.Done()
+	}
+	if stats := GetPoolStats(); stats.QueueLen != 0 || stats.QueueCap != 2 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
@@ -0,0 +1,223 @@
+package DnsServer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 规则上的解析器行为探测, 用来识别目标使用的解析器或解析库
+const (
+	// ProbeTruncate UDP 查询返回 TC=1 的空应答, 促使解析器改用 TCP 重试
+	ProbeTruncate = "truncate"
+	// ProbeDelay 延迟 ProbeArg 毫秒后再应答
+	ProbeDelay    = "delay"
+	ProbeServfail = "servfail"
+	ProbeRefused  = "refused"
+	// ProbeOversize 追加 ProbeArg 条记录, 使应答超过 512 字节或 EDNS 缓冲区
+	ProbeOversize = "oversize"
+	// ProbeCompress 在应答前面加上 ProbeArg 层 CNAME 链, 每个名称都只是一个 label 加压缩指针
+	ProbeCompress = "compress"
+)
+
+const (
+	// probeWindow 探测之后这段时间内对同一名称(及其子域名)的查询都关联到这次探测
+	probeWindow      = time.Minute
+	maxProbeDelay    = 10 * time.Second
+	maxProbeRecords  = 200
+	defaultProbeSize = 50
+	probeCleanupSize = 10000
+)
+
+var probeNames = map[string]bool{
+	ProbeTruncate: true,
+	ProbeDelay:    true,
+	ProbeServfail: true,
+	ProbeRefused:  true,
+	ProbeOversize: true,
+	ProbeCompress: true,
+}
+
+// IsProbe 判断探测方式是否受支持, 空字符串表示不探测
+func IsProbe(name string) bool {
+	return name == "" || probeNames[name]
+}
+
+// probeSession 一次探测, 后续的查询通过 id 关联
+type probeSession struct {
+	id      string
+	expires time.Time
+}
+
+var (
+	probeMu       sync.Mutex
+	probeSessions = make(map[string]*probeSession)
+)
+
+func newProbeID() string {
+	b := make([]byte, 6)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// trackProbe 触发探测时创建或延长探测会话, 否则查找该名称或其父域名上仍然有效的会话, 返回会话 id
+func trackProbe(domain string, triggered bool, now time.Time) string {
+	probeMu.Lock()
+	defer probeMu.Unlock()
+	if triggered {
+		session, ok := probeSessions[domain]
+		if !ok || now.After(session.expires) {
+			if len(probeSessions) >= probeCleanupSize {
+				for name, s := range probeSessions {
+					if now.After(s.expires) {
+						delete(probeSessions, name)
+					}
+				}
+			}
+			session = &probeSession{id: newProbeID()}
+			probeSessions[domain] = session
+		}
+		session.expires = now.Add(probeWindow)
+		return session.id
+	}
+	for name := domain; name != ""; {
+		if session, ok := probeSessions[name]; ok && !now.After(session.expires) {
+			return session.id
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+	}
+	return ""
+}
+
+// probeEntry 返回查询命中的带探测的规则, 查询类型没有规则时再看 CNAME 规则
+func probeEntry(domain string, qtype uint16) *ruleEntry {
+	for _, rtype := range []string{dns.TypeToString[qtype], "CNAME"} {
+		if entry := lookupRule(domain, rtype); entry != nil {
+			if entry.rule.Probe == "" {
+				return nil
+			}
+			return entry
+		}
+	}
+	return nil
+}
+
+// applyProbe 按规则的探测方式修改一个问题的应答记录, 截断和响应码设置在 msg 上.
+// 返回修改后的记录, 实际生效的探测方式, 关联的探测 id 以及应答需要延迟的时间.
+// 延迟由调用方在发送时处理, 这里不阻塞处理查询的 worker
+func applyProbe(msg *dns.Msg, q dns.Question, domain string, transport string, answer []dns.RR) ([]dns.RR, string, string, time.Duration) {
+	entry := probeEntry(domain, q.Qtype)
+	var applied string
+	var delay time.Duration
+	if entry != nil {
+		arg := entry.rule.ProbeArg
+		switch entry.rule.Probe {
+		case ProbeTruncate:
+			// TCP 重试时正常应答, 否则解析器会一直重试
+			if transport == TransportUDP {
+				answer = nil
+				msg.Truncated = true
+				applied = ProbeTruncate
+			}
+		case ProbeDelay:
+			delay = time.Duration(arg) * time.Millisecond
+			if delay > maxProbeDelay {
+				delay = maxProbeDelay
+			}
+			applied = ProbeDelay
+		case ProbeServfail:
+			answer = nil
+			msg.Rcode = dns.RcodeServerFailure
+			applied = ProbeServfail
+		case ProbeRefused:
+			answer = nil
+			msg.Rcode = dns.RcodeRefused
+			applied = ProbeRefused
+		case ProbeOversize:
+			answer = append(answer, oversizeRecords(q, probeCount(arg), entry.rule.Ttl)...)
+			applied = ProbeOversize
+		case ProbeCompress:
+			if len(answer) > 0 {
+				answer = compressChain(q, probeCount(arg), answer)
+				msg.Compress = true
+				applied = ProbeCompress
+			}
+		}
+	}
+	return answer, applied, trackProbe(domain, applied != "", time.Now()), delay
+}
+
+// tcpIdleTimeout TCP/DoT 连接的空闲超时, 需要比 maxProbeDelay 长,
+// 否则 miekg/dns 默认的 8 秒空闲超时会在 delay 探测的应答发出之前关闭连接
+func tcpIdleTimeout() time.Duration {
+	return maxProbeDelay + 2*time.Second
+}
+
+func probeCount(arg int) int {
+	if arg <= 0 {
+		return defaultProbeSize
+	}
+	if arg > maxProbeRecords {
+		return maxProbeRecords
+	}
+	return arg
+}
+
+// oversizeRecords 生成 n 条填充记录, A/AAAA 使用 198.18.0.0/15 和 2001:db8::/32 中的地址, 其他类型使用 TXT
+func oversizeRecords(q dns.Question, n int, ttl *uint32) []dns.RR {
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET}
+	if ttl != nil {
+		hdr.Ttl = *ttl
+	}
+	records := make([]dns.RR, 0, n)
+	for i := 0; i < n; i++ {
+		switch q.Qtype {
+		case dns.TypeA:
+			records = append(records, &dns.A{Hdr: hdr, A: net.IPv4(198, 18, byte(i>>8), byte(i)).To4()})
+		case dns.TypeAAAA:
+			ip := net.ParseIP("2001:db8::")
+			ip[14], ip[15] = byte(i>>8), byte(i)
+			records = append(records, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		default:
+			h := hdr
+			h.Rrtype = dns.TypeTXT
+			records = append(records, &dns.TXT{Hdr: h, Txt: []string{fmt.Sprintf("%03d", i) + strings.Repeat("x", 252)}})
+		}
+	}
+	return records
+}
+
+// compressChain 把原来的应答放到 n 层 CNAME 链的末尾: qname -> c1.qname -> ... -> cn.qname,
+// 名称超过 255 字节时链在这之前结束
+func compressChain(q dns.Question, n int, answer []dns.RR) []dns.RR {
+	ttl := answer[0].Header().Ttl
+	chain := make([]dns.RR, 0, n+len(answer))
+	owner := q.Name
+	for i := 1; i <= n; i++ {
+		target := fmt.Sprintf("c%d.%s", i, q.Name)
+		// 线上格式比以点结尾的表示形式多一个字节
+		if len(target)+1 > 255 {
+			break
+		}
+		chain = append(chain, &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: owner, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl},
+			Target: target,
+		})
+		owner = target
+	}
+	for _, rr := range answer {
+		rr = dns.Copy(rr)
+		rr.Header().Name = owner
+		chain = append(chain, rr)
+	}
+	return chain
+}
@@ -0,0 +1,51 @@
+package DnsServer
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestCompressChainNameLimit(t *testing.T) {
+	answer := []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP("192.0.2.1").To4(),
+	}}
+	long := strings.Repeat(strings.Repeat("a", 62)+".", 3) + strings.Repeat("b", 61) + "." // 线上格式 252 字节
+	tests := []struct {
+		name  string
+		qname string
+		n     int
+		want  int
+	}{
+		{"short name", "x.dnslog.test.", 200, 200},
+		// c1. 到 c9. 加 3 字节正好 255 字节, c10. 开始超过
+		{"long name", long, 200, 9},
+		{"full name", strings.Repeat(strings.Repeat("a", 62)+".", 4), 10, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain := compressChain(dns.Question{Name: tt.qname, Qtype: dns.TypeA}, tt.n, answer)
+			if got := len(chain) - len(answer); got != tt.want {
+				t.Fatalf("chain has %d CNAMEs, want %d", got, tt.want)
+			}
+			for _, rr := range chain {
+				if _, ok := dns.IsDomainName(rr.Header().Name); !ok {
+					t.Errorf("invalid owner name %q", rr.Header().Name)
+				}
+			}
+			// 最后一条 CNAME 指向原来的应答
+			if last := chain[len(chain)-1]; tt.want > 0 && last.Header().Name != chain[tt.want-1].(*dns.CNAME).Target {
+				t.Errorf("answer owner %q does not match last target", last.Header().Name)
+			}
+			msg := new(dns.Msg)
+			msg.SetQuestion(tt.qname, dns.TypeA)
+			msg.Answer = chain
+			msg.Compress = true
+			if _, err := msg.Pack(); err != nil {
+				t.Errorf("Pack: %v", err)
+			}
+		})
+	}
+}
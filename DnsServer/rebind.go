@@ -0,0 +1,163 @@
+package DnsServer
+
+import (
+	"bflog/db"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rebindStateTTL 按客户端记录的策略状态在 redis 中的保留时间
+const rebindStateTTL = 24 * time.Hour
+
+// RebindStrategy 决定一次 A/AAAA 查询返回规则中的哪些地址.
+// state 为该规则和策略独占的 redis key 前缀, 轮换状态都保存在它下面
+type RebindStrategy interface {
+	Pick(state string, values []string, client string, arg int) []string
+}
+
+// rebindStore 策略用到的 redis 操作, 由 *db.RedisClient 实现
+type rebindStore interface {
+	Incr(key string) (int64, error)
+	Expire(key string, expiration time.Duration) error
+	SetNX(key string, value interface{}, expiration time.Duration) (bool, error)
+	Peek(key string) (string, error)
+}
+
+// rebindRedis 返回保存策略状态的 redis
+var rebindRedis = func() rebindStore {
+	return db.GetRedis()
+}
+
+var rebindStrategies = map[string]RebindStrategy{
+	"roundrobin": roundRobinStrategy{},
+	"perclient":  perClientStrategy{},
+	"firstn":     firstNStrategy{},
+	"timewindow": timeWindowStrategy{},
+	"random":     randomStrategy{},
+	"all":        allStrategy{},
+}
+
+// IsRebindStrategy 判断策略名是否受支持, 空字符串表示默认的 roundrobin
+func IsRebindStrategy(name string) bool {
+	if name == "" {
+		return true
+	}
+	_, ok := rebindStrategies[name]
+	return ok
+}
+
+// pickValues 按规则配置的策略选择返回的地址,
+// 通配符和正则规则按查询的域名分别保存状态, 使每个 token 都从头开始轮换
+func pickValues(entry *ruleEntry, domain string, client string) []string {
+	name := entry.rule.Strategy
+	strategy, ok := rebindStrategies[name]
+	if !ok {
+		name, strategy = "roundrobin", rebindStrategies["roundrobin"]
+	}
+	state := fmt.Sprintf("rebind:%s:%d", name, entry.rule.ID)
+	if RuleMatchType(entry.rule) != MatchExact {
+		state += ":" + strings.ToLower(domain)
+	}
+	values := strategy.Pick(state, entry.values, client, entry.rule.StrategyArg)
+	if len(values) == 0 {
+		return entry.values[:1]
+	}
+	return values
+}
+
+// clientCounter 原子地增加某个客户端在该策略下的查询次数
+func clientCounter(state string, client string) (int64, error) {
+	key := state + ":" + client
+	n, err := rebindRedis().Incr(key)
+	if err != nil {
+		return 0, err
+	}
+	if n == 1 {
+		rebindRedis().Expire(key, rebindStateTTL)
+	}
+	return n, nil
+}
+
+// roundRobinStrategy 所有客户端共用一个轮换序列
+type roundRobinStrategy struct{}
+
+func (roundRobinStrategy) Pick(state string, values []string, client string, arg int) []string {
+	n, err := rebindRedis().Incr(state)
+	if err != nil {
+		return nil
+	}
+	// 通配符规则每个 token 都有一个计数器, 不设置过期时间会一直留在 redis 中
+	if n == 1 {
+		rebindRedis().Expire(state, rebindStateTTL)
+	}
+	return []string{values[(n-1)%int64(len(values))]}
+}
+
+// perClientStrategy 每个客户端 IP 各自从第一个地址开始轮换
+type perClientStrategy struct{}
+
+func (perClientStrategy) Pick(state string, values []string, client string, arg int) []string {
+	n, err := clientCounter(state, client)
+	if err != nil {
+		return nil
+	}
+	return []string{values[(n-1)%int64(len(values))]}
+}
+
+// firstNStrategy 每个客户端的前 arg 次查询返回第一个地址, 之后轮换其余地址
+type firstNStrategy struct{}
+
+func (firstNStrategy) Pick(state string, values []string, client string, arg int) []string {
+	if arg <= 0 {
+		arg = 1
+	}
+	n, err := clientCounter(state, client)
+	if err != nil {
+		return nil
+	}
+	if n <= int64(arg) || len(values) == 1 {
+		return values[:1]
+	}
+	rest := values[1:]
+	return []string{rest[(n-int64(arg)-1)%int64(len(rest))]}
+}
+
+// timeWindowStrategy 客户端首次查询后的 arg 秒内返回第一个地址, 之后返回第二个地址
+type timeWindowStrategy struct{}
+
+func (timeWindowStrategy) Pick(state string, values []string, client string, arg int) []string {
+	if arg <= 0 {
+		arg = 10
+	}
+	key := state + ":" + client
+	now := time.Now().Unix()
+	if _, err := rebindRedis().SetNX(key, now, rebindStateTTL); err != nil {
+		return nil
+	}
+	first, err := rebindRedis().Peek(key)
+	if err != nil {
+		return nil
+	}
+	start, _ := strconv.ParseInt(first, 10, 64)
+	if now-start < int64(arg) || len(values) == 1 {
+		return values[:1]
+	}
+	return values[1:2]
+}
+
+// randomStrategy 每次随机返回一个地址
+type randomStrategy struct{}
+
+func (randomStrategy) Pick(state string, values []string, client string, arg int) []string {
+	return []string{values[rand.Intn(len(values))]}
+}
+
+// allStrategy 在一个应答中返回全部地址
+type allStrategy struct{}
+
+func (allStrategy) Pick(state string, values []string, client string, arg int) []string {
+	return values
+}
@@ -0,0 +1,134 @@
+package DnsServer
+
+import (
+	"bflog/db"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// memStore 内存中的 rebindStore, 记录每个键设置的过期时间
+type memStore struct {
+	values  map[string]string
+	expires map[string]time.Duration
+}
+
+func (m *memStore) Incr(key string) (int64, error) {
+	n, _ := strconv.ParseInt(m.values[key], 10, 64)
+	n++
+	m.values[key] = strconv.FormatInt(n, 10)
+	return n, nil
+}
+
+func (m *memStore) Expire(key string, expiration time.Duration) error {
+	m.expires[key] = expiration
+	return nil
+}
+
+func (m *memStore) SetNX(key string, value interface{}, expiration time.Duration) (bool, error) {
+	if _, ok := m.values[key]; ok {
+		return false, nil
+	}
+	m.values[key] = strconv.FormatInt(value.(int64), 10)
+	m.expires[key] = expiration
+	return true, nil
+}
+
+func (m *memStore) Peek(key string) (string, error) {
+	return m.values[key], nil
+}
+
+func setupRebind(t *testing.T) *memStore {
+	t.Helper()
+	store := &memStore{values: map[string]string{}, expires: map[string]time.Duration{}}
+	rebindRedis = func() rebindStore { return store }
+	t.Cleanup(func() {
+		rebindRedis = func() rebindStore { return db.GetRedis() }
+	})
+	return store
+}
+
+func TestRebindStrategies(t *testing.T) {
+	values := []string{"1.1.1.1", "127.0.0.1", "10.0.0.1"}
+	tests := []struct {
+		strategy string
+		arg      int
+		// 按顺序发出的查询的客户端和期望的地址
+		clients []string
+		want    []string
+	}{
+		{"roundrobin", 0,
+			[]string{"a", "b", "a", "b"},
+			[]string{"1.1.1.1", "127.0.0.1", "10.0.0.1", "1.1.1.1"}},
+		{"perclient", 0,
+			[]string{"a", "a", "b", "a", "b"},
+			[]string{"1.1.1.1", "127.0.0.1", "1.1.1.1", "10.0.0.1", "127.0.0.1"}},
+		{"firstn", 2,
+			[]string{"a", "a", "a", "a", "a", "b"},
+			[]string{"1.1.1.1", "1.1.1.1", "127.0.0.1", "10.0.0.1", "127.0.0.1", "1.1.1.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			store := setupRebind(t)
+			entry := &ruleEntry{rule: db.DnsRule{ID: 7, Name: "r.dnslog.test", Type: "A", Strategy: tt.strategy, StrategyArg: tt.arg}, values: values}
+			for i, client := range tt.clients {
+				if got := pickValues(entry, "r.dnslog.test", client); got[0] != tt.want[i] {
+					t.Errorf("query %d from %s: got %v, want %s", i, client, got, tt.want[i])
+				}
+			}
+			for key := range store.values {
+				if store.expires[key] != rebindStateTTL {
+					t.Errorf("key %s expires in %v, want %v", key, store.expires[key], rebindStateTTL)
+				}
+			}
+		})
+	}
+}
+
+func TestRebindAllStrategy(t *testing.T) {
+	setupRebind(t)
+	entry := &ruleEntry{rule: db.DnsRule{ID: 1, Name: "a.dnslog.test", Type: "A", Strategy: "all"}, values: []string{"1.1.1.1", "127.0.0.1"}}
+	if got := pickValues(entry, "a.dnslog.test", "a"); len(got) != 2 {
+		t.Errorf("got %v, want both addresses", got)
+	}
+}
+
+func TestRebindTimeWindow(t *testing.T) {
+	store := setupRebind(t)
+	entry := &ruleEntry{rule: db.DnsRule{ID: 3, Name: "t.dnslog.test", Type: "A", Strategy: "timewindow", StrategyArg: 30}, values: []string{"1.1.1.1", "127.0.0.1"}}
+	if got := pickValues(entry, "t.dnslog.test", "a"); got[0] != "1.1.1.1" {
+		t.Fatalf("first query: got %v", got)
+	}
+	key := "rebind:timewindow:3:a"
+	if _, ok := store.values[key]; !ok || store.expires[key] != rebindStateTTL {
+		t.Fatalf("state key %s not set with ttl: %v", key, store.values)
+	}
+	if got := pickValues(entry, "t.dnslog.test", "a"); got[0] != "1.1.1.1" {
+		t.Errorf("inside window: got %v", got)
+	}
+	// 把首次查询时间移到窗口之前
+	store.values[key] = strconv.FormatInt(time.Now().Unix()-31, 10)
+	if got := pickValues(entry, "t.dnslog.test", "a"); got[0] != "127.0.0.1" {
+		t.Errorf("after window: got %v", got)
+	}
+	if got := pickValues(entry, "t.dnslog.test", "b"); got[0] != "1.1.1.1" {
+		t.Errorf("new client: got %v", got)
+	}
+}
+
+func TestRebindWildcardState(t *testing.T) {
+	store := setupRebind(t)
+	entry := &ruleEntry{rule: db.DnsRule{ID: 5, Name: "*.w.dnslog.test", Type: "A"}, values: []string{"1.1.1.1", "127.0.0.1"}}
+	// 每个 token 都从第一个地址开始轮换
+	for _, domain := range []string{"x.w.dnslog.test", "Y.w.dnslog.test", "x.w.dnslog.test"} {
+		pickValues(entry, domain, "a")
+	}
+	if got := pickValues(entry, "y.w.dnslog.test", "a"); got[0] != "127.0.0.1" {
+		t.Errorf("second query for token y: got %v", got)
+	}
+	for _, key := range []string{"rebind:roundrobin:5:x.w.dnslog.test", "rebind:roundrobin:5:y.w.dnslog.test"} {
+		if store.expires[key] != rebindStateTTL {
+			t.Errorf("key %s expires in %v, want %v", key, store.expires[key], rebindStateTTL)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package DnsServer
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ruleValues 返回规则中该类型要应答的记录值以及 TTL, A/AAAA 按规则的 rebinding 策略选择
+func ruleValues(domain string, rtype string, z *zone, client string) ([]string, uint32) {
+	entry := lookupRule(domain, rtype)
+	if entry == nil {
+		return nil, 0
+	}
+	if rtype == "A" || rtype == "AAAA" {
+		return pickValues(entry, domain, client), ruleTTL(entry, z)
+	}
+	return entry.values, ruleTTL(entry, z)
+}
+
+// ruleTTL 规则设置了 TTL 时使用规则的值; 否则轮换多个地址的 A/AAAA 规则为 0, 让解析器每次都重新查询,
+// 其他规则使用区域的默认 TTL
+func ruleTTL(entry *ruleEntry, z *zone) uint32 {
+	if entry.rule.Ttl != nil {
+		return *entry.rule.Ttl
+	}
+	if (entry.rule.Type == "A" || entry.rule.Type == "AAAA") && len(entry.values) > 1 {
+		return 0
+	}
+	return z.defaultTTL()
+}
+
+// newRR 根据记录类型和规则中的值构造应答记录
+func newRR(name string, qtype uint16, value string, ttl uint32) (dns.RR, error) {
+	hdr := dns.RR_Header{
+		Name:   name,
+		Rrtype: qtype,
+		Class:  dns.ClassINET,
+		Ttl:    ttl,
+	}
+	value = strings.TrimSpace(value)
+	switch qtype {
+	case dns.TypeA:
+		ip := net.ParseIP(value)
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("invalid ipv4 address: %s", value)
+		}
+		return &dns.A{Hdr: hdr, A: ip.To4()}, nil
+	case dns.TypeAAAA:
+		ip := net.ParseIP(value)
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("invalid ipv6 address: %s", value)
+		}
+		return &dns.AAAA{Hdr: hdr, AAAA: ip}, nil
+	case dns.TypeTXT:
+		return &dns.TXT{Hdr: hdr, Txt: splitTXT(value)}, nil
+	case dns.TypeCNAME:
+		return &dns.CNAME{Hdr: hdr, Target: dns.Fqdn(value)}, nil
+	case dns.TypeMX:
+		// MX 记录格式为 "优先级 主机", 省略优先级时默认 10
+		pref := 10
+		host := value
+		if fields := strings.Fields(value); len(fields) == 2 {
+			p, err := strconv.Atoi(fields[0])
+			if err != nil || p < 0 || p > 65535 {
+				return nil, fmt.Errorf("invalid mx preference: %s", value)
+			}
+			pref, host = p, fields[1]
+		}
+		return &dns.MX{Hdr: hdr, Preference: uint16(pref), Mx: dns.Fqdn(host)}, nil
+	}
+	return nil, fmt.Errorf("unsupported record type: %s", dns.TypeToString[qtype])
+}
+
+// splitTXT 把超过 255 字节的文本拆成多个字符串
+func splitTXT(value string) []string {
+	var parts []string
+	for len(value) > 255 {
+		parts = append(parts, value[:255])
+		value = value[255:]
+	}
+	return append(parts, value)
+}
+
+// ValidateRuleValue 校验规则值能否构造成对应类型的记录
+func ValidateRuleValue(rtype string, value string) error {
+	_, err := newRR("check.", dns.StringToType[rtype], value, 0)
+	return err
+}
+
+// buildAnswer 根据规则为问题构造应答, 未命中规则时 A/AAAA 返回区域的默认地址
+func buildAnswer(q dns.Question, domain string, z *zone, client string) []dns.RR {
+	if answer, ok := acmeAnswer(q, domain, z); ok {
+		return answer
+	}
+	var ttl uint32
+	var values []string
+	rtype := q.Qtype
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeAAAA, dns.TypeTXT, dns.TypeMX, dns.TypeCNAME:
+		values, ttl = ruleValues(domain, dns.TypeToString[q.Qtype], z, client)
+	}
+	// CNAME 规则对其他类型的查询同样生效
+	if len(values) == 0 && q.Qtype != dns.TypeCNAME {
+		if cname, cnameTTL := ruleValues(domain, "CNAME", z, client); len(cname) > 0 {
+			values, ttl = cname, cnameTTL
+			rtype = dns.TypeCNAME
+		}
+	}
+	if len(values) == 0 {
+		switch q.Qtype {
+		case dns.TypeA:
+			values = []string{z.cfg.DefaultIp}
+		case dns.TypeAAAA:
+			if z.cfg.DefaultIpv6 != "" {
+				values = []string{z.cfg.DefaultIpv6}
+			}
+		}
+		ttl = z.defaultTTL()
+	}
+	if rtype == dns.TypeCNAME && len(values) > 1 {
+		values = values[:1]
+	}
+
+	var answer []dns.RR
+	for _, value := range values {
+		rr, err := newRR(q.Name, rtype, value, ttl)
+		if err != nil {
+			logrus.Warnf("skip dns rule value for %s: %v", domain, err)
+			continue
+		}
+		answer = append(answer, rr)
+	}
+	return answer
+}
@@ -0,0 +1,126 @@
+package DnsServer
+
+import (
+	"bflog/config"
+	"bufio"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resolverWatchInterval 检查解析器数据文件是否被修改的间隔
+const resolverWatchInterval = 10 * time.Second
+
+// resolverRange 一个公共解析器网段及其标签
+type resolverRange struct {
+	network *net.IPNet
+	tag     string
+}
+
+var (
+	resolverMu      sync.RWMutex
+	resolverRanges  []resolverRange
+	resolverModTime time.Time
+)
+
+// resolverFile 返回解析器数据文件路径, 默认 resolvers.txt
+func resolverFile() string {
+	if file := config.GetBase().Dns.ResolverFile; file != "" {
+		return file
+	}
+	return "resolvers.txt"
+}
+
+// ReloadResolvers 重新加载解析器网段数据, 返回加载的网段数量
+func ReloadResolvers() (int, error) {
+	file := resolverFile()
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	var ranges []resolverRange
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return 0, fmt.Errorf("%s:%d: expected \"cidr tag\"", file, line)
+		}
+		_, network, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return 0, fmt.Errorf("%s:%d: %v", file, line, err)
+		}
+		ranges = append(ranges, resolverRange{network: network, tag: fields[1]})
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	// 前缀越长越具体, 优先匹配
+	sort.SliceStable(ranges, func(i, j int) bool {
+		a, _ := ranges[i].network.Mask.Size()
+		b, _ := ranges[j].network.Mask.Size()
+		return a > b
+	})
+
+	resolverMu.Lock()
+	resolverRanges = ranges
+	resolverModTime = info.ModTime()
+	resolverMu.Unlock()
+	return len(ranges), nil
+}
+
+// watchResolvers 数据文件被修改后自动重新加载
+func watchResolvers() {
+	ticker := time.NewTicker(resolverWatchInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		info, err := os.Stat(resolverFile())
+		if err != nil {
+			continue
+		}
+		resolverMu.RLock()
+		changed := !info.ModTime().Equal(resolverModTime)
+		resolverMu.RUnlock()
+		if !changed {
+			continue
+		}
+		if n, err := ReloadResolvers(); err != nil {
+			logrus.Errorf("reload resolvers: %v", err)
+		} else {
+			logrus.Infof("reloaded %d resolver ranges", n)
+		}
+	}
+}
+
+// ClassifyResolver 返回客户端地址所属公共解析器的标签, 不属于任何已知解析器时返回空
+func ClassifyResolver(clientIP string) string {
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return ""
+	}
+	resolverMu.RLock()
+	defer resolverMu.RUnlock()
+	for _, r := range resolverRanges {
+		if r.network.Contains(ip) {
+			return r.tag
+		}
+	}
+	return ""
+}
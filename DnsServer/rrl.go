@@ -0,0 +1,253 @@
+package DnsServer
+
+import (
+	"bflog/config"
+	"container/list"
+	"github.com/miekg/dns"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RRL 对每个应答的处理结果
+const (
+	rrlAllow = iota
+	rrlDrop
+	rrlSlip
+)
+
+const (
+	// rrlCleanupInterval 清理长时间空闲的计数桶的间隔
+	rrlCleanupInterval = time.Minute
+	// defaultRRLBuckets 计数桶数量的默认上限
+	defaultRRLBuckets = 100000
+	// defaultRRLWindow 未配置 window 时的秒数
+	defaultRRLWindow = 15
+)
+
+// rrlWindow 返回配置的 window, 未配置时使用 defaultRRLWindow
+func rrlWindow() time.Duration {
+	window := config.GetBase().Dns.Rrl.Window
+	if window <= 0 {
+		window = defaultRRLWindow
+	}
+	return time.Duration(window) * time.Second
+}
+
+// rrlBucket 令牌桶, 余额可以透支到 -rate*window, 持续刷量的来源在停止后仍会被限制一个 window
+type rrlBucket struct {
+	key     string
+	tokens  float64
+	last    time.Time
+	limited int64
+}
+
+// RRLHit 当前被限速的来源
+type RRLHit struct {
+	Key     string `json:"key"`
+	Limited int64  `json:"limited"`
+}
+
+// RRLStats 限速统计
+type RRLStats struct {
+	Enabled bool     `json:"enabled"`
+	Allowed int64    `json:"allowed"`
+	Dropped int64    `json:"dropped"`
+	Slipped int64    `json:"slipped"`
+	Logged  int64    `json:"logged"`
+	Top     []RRLHit `json:"top"`
+}
+
+var (
+	rrlMu sync.Mutex
+	// rrlBuckets 计数桶, rrlLRU 按最近使用排序, 最久没有使用的在末尾, 数量达到上限时先淘汰
+	rrlBuckets = make(map[string]*list.Element)
+	rrlLRU     = list.New()
+	rrlSeq     atomic.Int64
+	rrlLogSeq  atomic.Int64
+	rrlAllowed atomic.Int64
+	rrlDropped atomic.Int64
+	rrlSlipped atomic.Int64
+	rrlLogged  atomic.Int64
+)
+
+// rrlPrefix 把来源地址归并到配置的网段
+func rrlPrefix(clientIP string) string {
+	cfg := config.GetBase().Dns.Rrl
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return clientIP
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		bits := cfg.Ipv4Prefix
+		if bits <= 0 || bits > 32 {
+			bits = 24
+		}
+		return ip4.Mask(net.CIDRMask(bits, 32)).String()
+	}
+	bits := cfg.Ipv6Prefix
+	if bits <= 0 || bits > 128 {
+		bits = 56
+	}
+	return ip.Mask(net.CIDRMask(bits, 128)).String()
+}
+
+// rrlTake 从桶中扣除 cost, 余额不足时返回 false
+func rrlTake(key string, rate float64, cost float64, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+	window := rrlWindow().Seconds()
+	bucket := rrlGetBucket(key, rate, now)
+	bucket.tokens += now.Sub(bucket.last).Seconds() * rate
+	if bucket.tokens > rate {
+		bucket.tokens = rate
+	}
+	bucket.last = now
+	bucket.tokens -= cost
+	if bucket.tokens < -rate*window {
+		bucket.tokens = -rate * window
+	}
+	if bucket.tokens < 0 {
+		bucket.limited++
+		return false
+	}
+	return true
+}
+
+// rrlGetBucket 返回 key 对应的计数桶并标记为最近使用, 桶的数量达到 max_buckets 时淘汰最久没有使用的桶.
+// 伪造大量来源的查询洪水因此不会让计数表无限增长
+func rrlGetBucket(key string, rate float64, now time.Time) *rrlBucket {
+	if elem, ok := rrlBuckets[key]; ok {
+		rrlLRU.MoveToFront(elem)
+		return elem.Value.(*rrlBucket)
+	}
+	limit := config.GetBase().Dns.Rrl.MaxBuckets
+	if limit <= 0 {
+		limit = defaultRRLBuckets
+	}
+	for len(rrlBuckets) >= limit {
+		oldest := rrlLRU.Back()
+		delete(rrlBuckets, oldest.Value.(*rrlBucket).key)
+		rrlLRU.Remove(oldest)
+	}
+	bucket := &rrlBucket{key: key, tokens: rate, last: now}
+	rrlBuckets[key] = rrlLRU.PushFront(bucket)
+	return bucket
+}
+
+// rrlCheck 按来源网段/查询名/应答大小判断是否限速, 只对 UDP 生效
+func rrlCheck(clientIP string, msg *dns.Msg) int {
+	cfg := config.GetBase().Dns.Rrl
+	if !cfg.Enabled {
+		return rrlAllow
+	}
+	prefix := rrlPrefix(clientIP)
+	qname := ""
+	if len(msg.Question) > 0 {
+		qname = strings.ToLower(msg.Question[0].Name)
+	}
+	// 正常应答按查询名计数, NXDOMAIN 按区域计数以防随机子域绕过, 其他错误按来源网段计数
+	var key string
+	rate := float64(cfg.ResponsesPerSecond)
+	switch {
+	case msg.Rcode == dns.RcodeNameError:
+		zoneKey := ""
+		if z := findZone(qname); z != nil {
+			zoneKey = z.name
+		}
+		key, rate = prefix+"|nx|"+zoneKey, float64(cfg.ErrorsPerSecond)
+	case msg.Rcode != dns.RcodeSuccess:
+		key, rate = prefix+"|err", float64(cfg.ErrorsPerSecond)
+	default:
+		key = prefix + "|" + qname
+	}
+
+	now := time.Now()
+	rrlMu.Lock()
+	allowed := rrlTake(key, rate, 1, now) &&
+		rrlTake("qname|"+qname, float64(cfg.QnamePerSecond), 1, now) &&
+		rrlTake(prefix+"|bytes", float64(cfg.BytesPerSecond), float64(msg.Len()), now)
+	rrlMu.Unlock()
+	if allowed {
+		rrlAllowed.Add(1)
+		return rrlAllow
+	}
+	// 每 slip 个被限速的应答中返回一个 TC=1 的空应答, 让真实客户端可以改用 TCP
+	if cfg.Slip > 0 && rrlSeq.Add(1)%int64(cfg.Slip) == 0 {
+		rrlSlipped.Add(1)
+		return rrlSlip
+	}
+	rrlDropped.Add(1)
+	return rrlDrop
+}
+
+// rrlShouldLog 被限速的查询按 log_sample 采样记录, 而不是全部丢弃
+func rrlShouldLog() bool {
+	rate := int64(config.GetBase().Dns.Rrl.LogSample)
+	if rate <= 1 || rrlLogSeq.Add(1)%rate == 0 {
+		rrlLogged.Add(1)
+		return true
+	}
+	return false
+}
+
+// slipReply 构造只带问题段并设置 TC 的应答
+func slipReply(r *dns.Msg) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetReply(r)
+	msg.Authoritative = true
+	msg.Truncated = true
+	return msg
+}
+
+// cleanupRRL 定期清理空闲的计数桶
+func cleanupRRL() {
+	ticker := time.NewTicker(rrlCleanupInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		expireRRL(now)
+	}
+}
+
+// expireRRL 删除在 window 加一个清理间隔内没有使用过的计数桶
+func expireRRL(now time.Time) {
+	expire := now.Add(-rrlWindow() - rrlCleanupInterval)
+	rrlMu.Lock()
+	defer rrlMu.Unlock()
+	// 从最久没有使用的桶开始清理, 遇到仍在使用的桶就停止
+	for elem := rrlLRU.Back(); elem != nil; elem = rrlLRU.Back() {
+		bucket := elem.Value.(*rrlBucket)
+		if !bucket.last.Before(expire) {
+			break
+		}
+		delete(rrlBuckets, bucket.key)
+		rrlLRU.Remove(elem)
+	}
+}
+
+// GetRRLStats 返回限速统计以及被限速次数最多的来源
+func GetRRLStats() RRLStats {
+	stats := RRLStats{
+		Enabled: config.GetBase().Dns.Rrl.Enabled,
+		Allowed: rrlAllowed.Load(),
+		Dropped: rrlDropped.Load(),
+		Slipped: rrlSlipped.Load(),
+		Logged:  rrlLogged.Load(),
+	}
+	rrlMu.Lock()
+	for elem := rrlLRU.Front(); elem != nil; elem = elem.Next() {
+		if bucket := elem.Value.(*rrlBucket); bucket.limited > 0 {
+			stats.Top = append(stats.Top, RRLHit{Key: bucket.key, Limited: bucket.limited})
+		}
+	}
+	rrlMu.Unlock()
+	sort.Slice(stats.Top, func(i, j int) bool { return stats.Top[i].Limited > stats.Top[j].Limited })
+	if len(stats.Top) > 50 {
+		stats.Top = stats.Top[:50]
+	}
+	return stats
+}
@@ -0,0 +1,128 @@
+package DnsServer
+
+import (
+	"bflog/config"
+	"container/list"
+	"github.com/miekg/dns"
+	"testing"
+	"time"
+)
+
+// setupRRL 使用只包含 RRL 配置的 config, 并清空计数桶和统计
+func setupRRL(t *testing.T, rrl config.RrlConfig) {
+	t.Helper()
+	cfg := &config.Config{}
+	cfg.Server.Subdomain = "dnslog.test"
+	cfg.Dns.Rrl = rrl
+	config.SetBase(cfg)
+	resetRRL()
+	rrlSeq.Store(0)
+	t.Cleanup(func() { config.SetBase(nil) })
+}
+
+func resetRRL() {
+	rrlMu.Lock()
+	rrlBuckets = make(map[string]*list.Element)
+	rrlLRU.Init()
+	rrlMu.Unlock()
+}
+
+func rrlBucketOf(key string) *rrlBucket {
+	if elem, ok := rrlBuckets[key]; ok {
+		return elem.Value.(*rrlBucket)
+	}
+	return nil
+}
+
+func TestRRLTake(t *testing.T) {
+	setupRRL(t, config.RrlConfig{Enabled: true, Window: 2})
+	now := time.Now()
+	steps := []struct {
+		after   time.Duration
+		cost    float64
+		allowed bool
+		tokens  float64
+	}{
+		{0, 1, true, 1},
+		{0, 1, true, 0},
+		{0, 1, false, -1},
+		{0, 10, false, -4}, // 最多透支 rate*window
+		{time.Second, 1, false, -3},
+		{3 * time.Second, 1, true, 1}, // 补充后不超过 rate
+	}
+	for i, step := range steps {
+		now = now.Add(step.after)
+		if got := rrlTake("k", 2, step.cost, now); got != step.allowed {
+			t.Errorf("step %d: allowed = %t, want %t", i, got, step.allowed)
+		}
+		if bucket := rrlBucketOf("k"); bucket.tokens != step.tokens {
+			t.Errorf("step %d: tokens = %v, want %v", i, bucket.tokens, step.tokens)
+		}
+	}
+	if bucket := rrlBucketOf("k"); bucket.limited != 3 {
+		t.Errorf("limited = %d, want 3", bucket.limited)
+	}
+	// rate 为 0 时不限速, 也不创建计数桶
+	if !rrlTake("free", 0, 1, now) || rrlBucketOf("free") != nil {
+		t.Error("rate 0 should not be limited")
+	}
+}
+
+func TestRRLMaxBuckets(t *testing.T) {
+	setupRRL(t, config.RrlConfig{Enabled: true, MaxBuckets: 3})
+	now := time.Now()
+	for _, key := range []string{"a", "b", "c", "a", "d"} {
+		rrlTake(key, 10, 1, now)
+	}
+	if len(rrlBuckets) != 3 || rrlLRU.Len() != 3 {
+		t.Fatalf("buckets = %d, lru = %d, want 3", len(rrlBuckets), rrlLRU.Len())
+	}
+	// b 最久没有使用, 被 d 淘汰
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		if got := rrlBucketOf(key) != nil; got != want {
+			t.Errorf("bucket %s present = %t, want %t", key, got, want)
+		}
+	}
+	if bucket := rrlBucketOf("a"); bucket.tokens != 8 {
+		t.Errorf("a tokens = %v, want 8", bucket.tokens)
+	}
+}
+
+func TestRRLSlip(t *testing.T) {
+	setupRRL(t, config.RrlConfig{Enabled: true, ResponsesPerSecond: 1, Window: 15, Slip: 2})
+	r := new(dns.Msg)
+	r.SetQuestion("a.dnslog.test.", dns.TypeA)
+	msg := new(dns.Msg)
+	msg.SetReply(r)
+
+	want := []int{rrlAllow, rrlDrop, rrlSlip, rrlDrop, rrlSlip}
+	for i, w := range want {
+		if got := rrlCheck("192.0.2.1", msg); got != w {
+			t.Errorf("query %d: rrlCheck = %d, want %d", i, got, w)
+		}
+	}
+	// 同一网段的其他地址共用计数桶, 其他网段不受影响
+	if got := rrlCheck("192.0.2.200", msg); got == rrlAllow {
+		t.Error("same /24 should be limited")
+	}
+	if got := rrlCheck("198.51.100.1", msg); got != rrlAllow {
+		t.Errorf("other prefix: rrlCheck = %d, want allow", got)
+	}
+
+	slip := slipReply(r)
+	if !slip.Truncated || len(slip.Answer) != 0 || slip.Id != r.Id {
+		t.Errorf("slip reply: tc=%t answer=%d id=%d", slip.Truncated, len(slip.Answer), slip.Id)
+	}
+}
+
+func TestExpireRRL(t *testing.T) {
+	// 未配置 window 时清理和透支都使用默认的 15 秒
+	setupRRL(t, config.RrlConfig{Enabled: true})
+	now := time.Now()
+	rrlTake("old", 1, 1, now.Add(-80*time.Second))
+	rrlTake("recent", 1, 1, now.Add(-70*time.Second))
+	expireRRL(now)
+	if rrlBucketOf("old") != nil || rrlBucketOf("recent") == nil || rrlLRU.Len() != 1 {
+		t.Errorf("old present = %t, recent present = %t", rrlBucketOf("old") != nil, rrlBucketOf("recent") != nil)
+	}
+}
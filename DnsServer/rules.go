@@ -0,0 +1,67 @@
+package DnsServer
+
+import (
+	"bflog/db"
+	"github.com/sirupsen/logrus"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ruleRefreshInterval 定时从数据库重新加载规则, 让多实例部署之间的规则保持一致
+const ruleRefreshInterval = 10 * time.Second
+
+// ruleEntry 内存中的一条规则以及拆分好的记录值
+type ruleEntry struct {
+	rule   db.DnsRule
+	values []string
+	re     *regexp.Regexp
+}
+
+// ruleTable 当前生效的 *ruleMatcher, 整体替换保证读取时无需加锁
+var ruleTable atomic.Value
+
+// ReloadRules 从数据库重新加载全部 DNS 规则.
+// 规则以 MySQL 中的记录为准, 旧版本按 DnsRuleKey 写入 redis 的记录值列表不再读取, 升级后可以删除
+func ReloadRules() error {
+	rules, err := db.GetDB().GetAllDnsRules()
+	if err != nil {
+		return err
+	}
+	entries := make([]*ruleEntry, 0, len(rules))
+	for _, rule := range rules {
+		rtype := strings.ToUpper(rule.Type)
+		if rtype == "" {
+			rtype = "A"
+		}
+		rule.Type = rtype
+		entries = append(entries, &ruleEntry{rule: rule, values: rule.IPAddresses.Trimmed()})
+	}
+	ruleTable.Store(newRuleMatcher(entries))
+	return nil
+}
+
+// refreshRules 周期性重新加载规则
+func refreshRules() {
+	ticker := time.NewTicker(ruleRefreshInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := ReloadRules(); err != nil {
+			logrus.Errorf("reload dns rules: %v", err)
+		}
+	}
+}
+
+// lookupRule 查找域名对应类型的规则, 没有时返回 nil
+func lookupRule(domain string, rtype string) *ruleEntry {
+	matcher, _ := ruleTable.Load().(*ruleMatcher)
+	if matcher == nil {
+		return nil
+	}
+	entry := matcher.match(strings.ToLower(domain), rtype)
+	if entry == nil || len(entry.values) == 0 {
+		return nil
+	}
+	return entry
+}
@@ -16,82 +16,228 @@ func removeTrailingDot(name string) string {
 	return strings.TrimSuffix(name, ".")
 }
 
-func GetNextIPAddress(domain string) string {
-
-	ip, _ := db.GetRedis().LPop(domain)
-	if ip == "" {
-		return config.GetBase().Server.Defaultip
-	}
-	if ip != "" {
-		db.GetRedis().RPush(domain, ip)
+// clientAddr 去掉来源地址中的端口
+func clientAddr(receiveIP string) string {
+	clientIP, _, err := net.SplitHostPort(receiveIP)
+	if err != nil {
+		return receiveIP
 	}
-	return ip
+	return clientIP
 }
 
+// InsertRecord 记录写入队列, 不会阻塞应答
 func InsertRecord(record db.Dnslog) {
-	select {
-	case db.GetDB().InsertCh <- record:
+	db.GetDB().InsertRecord(record)
+}
+
+// 查询到达的传输方式, 记录在 dnslog 中
+const (
+	TransportUDP = "udp"
+	TransportTCP = "tcp"
+	TransportDoT = "dot"
+	TransportDoH = "doh"
+)
+
+func handleDNSRequest(w dns.ResponseWriter, r *dns.Msg, transport string) {
+	// 转发的查询要等待上游, 交给单独的协程, 不占用 worker
+	if forwardQuery(r) {
+		forwardAsync(w, r, transport)
+		return
+	}
+	msg, delay := resolveDNSMessage(r, w.RemoteAddr().String(), transport)
+	if msg == nil {
+		return
+	}
+	// delay 探测的应答由定时器发送, worker 立即去处理下一条查询
+	if delay > 0 {
+		time.AfterFunc(delay, func() {
+			w.WriteMsg(msg)
+		})
+		return
+	}
+	// 发送响应
+	w.WriteMsg(msg)
+}
 
+// HandleDNSMessage 处理一条查询并返回应答, 各种传输方式(UDP/TCP/DoT/DoH)共用这段逻辑.
+// receiveIP 为客户端地址, 可以带端口. 应答被限速丢弃或者服务器正在停止时返回 nil.
+// delay 探测在返回前等待, 只用于 DoH 这类每个请求有自己 goroutine 的调用方
+func HandleDNSMessage(r *dns.Msg, receiveIP string, transport string) *dns.Msg {
+	if !beginQuery() {
+		return nil
 	}
+	msg, delay := resolveDNSMessage(r, receiveIP, transport)
+	inflight.Done()
+	if msg != nil && delay > 0 {
+		time.Sleep(delay)
+	}
+	return msg
 }
 
-func handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
+// resolveDNSMessage 生成应答, 同时返回 delay 探测要求的发送延迟
+func resolveDNSMessage(r *dns.Msg, receiveIP string, transport string) (*dns.Msg, time.Duration) {
 	// 创建响应消息
-	msg := dns.Msg{}
+	msg := new(dns.Msg)
 	msg.SetReply(r)
+	msg.Authoritative = true
+
+	clientIP := clientAddr(receiveIP)
 
-	receiveIP := w.RemoteAddr().String()
-	ttl := 60
+	// 开启转发时区域外的查询交给上游解析器, 单独记录
+	if forwardQuery(r) {
+		return forwardMessage(r, receiveIP, clientIP, transport), 0
+	}
 
 	//logrus.Info(receiveIP)
-	// 记录请求
+	// 记录请求, 应答确定之后再写入 dnslog
+	var records []db.Dnslog
+	// matched 为第一个问题所属的区域, 否定应答的 SOA 和 DNSSEC 签名都使用它
+	var matched *zone
+	// delay 多个问题都命中 delay 探测时取最长的延迟
+	var delay time.Duration
 	for _, q := range r.Question {
-		if strings.HasSuffix(q.Name, config.GetBase().Server.Subdomain) {
-			//logrus.Info(config.GetBase().Server.Subdomain)
-			defaultip := config.GetBase().Server.Defaultip
-			//logrus.Info(defaultip)
-			domain := removeTrailingDot(q.Name)
-			ip := GetNextIPAddress(domain)
-			if ip != "" {
-				defaultip = ip
-				ttl = 0
-			}
-			record := db.Dnslog{
-				ReceiveIP:   receiveIP,
-				QueryName:   domain,
-				QueryType:   dns.TypeToString[q.Qtype],
-				CreatedTime: time.Now(),
+		z := findZone(q.Name)
+		if z == nil {
+			// 不属于任何区域的查询直接拒绝, 避免被当作 lame delegation
+			msg.Authoritative = false
+			msg.Rcode = outOfZoneRcode()
+			continue
+		}
+		if matched == nil {
+			matched = z
+		}
+		record := newDnslog(r, q, receiveIP, transport)
+		record.Zone = removeTrailingDot(z.name)
+		record.ResolverTag = ClassifyResolver(clientIP)
+		// 命中噪音规则的查询照常应答, 按规则不记录或者记录到噪音中
+		noise := db.MatchDnsNoise(clientIP, record.QueryName, record.QueryType)
+		observeExfil(q.Name, z, clientIP)
+		if !z.authorityAnswer(msg, q) {
+			answer := buildAnswer(q, record.QueryName, z, clientIP)
+			var wait time.Duration
+			answer, record.Probe, record.ProbeID, wait = applyProbe(msg, q, record.QueryName, transport, answer)
+			if wait > delay {
+				delay = wait
 			}
+			msg.Answer = append(msg.Answer, answer...)
+		}
+		switch noise {
+		case db.NoiseIgnore:
+		case db.NoiseStore:
+			record.Noise = true
+			records = append(records, record)
+		default:
+			records = append(records, record)
+		}
+	}
+	// NODATA 应答在 authority 段附带 SOA, 供解析器做否定缓存. 探测截断的应答不带 SOA, 以免被当作 NODATA 缓存
+	if matched != nil && msg.Rcode == dns.RcodeSuccess && len(msg.Answer) == 0 && !msg.Truncated {
+		msg.Ns = append(msg.Ns, matched.negativeSOA())
+	}
+
+	// 带 EDNS 的查询在应答中回带 OPT, DO 标志原样返回
+	if opt := r.IsEdns0(); opt != nil {
+		if matched != nil {
+			signResponse(r, msg, matched)
+		}
+		msg.SetEdns0(dns.DefaultMsgSize, opt.Do())
+	}
+
+	// UDP 应答超过客户端可接收的大小时截断并设置 TC, 让客户端改用 TCP 重试
+	if transport == TransportUDP {
+		size := dns.MinMsgSize
+		if opt := r.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+		// Truncate 在应答不需要压缩就能放下时会关闭压缩, compress 探测需要保留
+		compress := msg.Compress
+		msg.Truncate(size)
+		msg.Compress = msg.Compress || compress
+	}
+
+	answer := answerText(msg)
+	ttl := responseTTL(msg)
+	logged := true
+	// 只对可以伪造来源的 UDP 限速
+	if transport == TransportUDP {
+		switch rrlCheck(clientIP, msg) {
+		case rrlDrop:
+			msg = nil
+			answer += "\n(RRL drop)"
+			logged = rrlShouldLog()
+		case rrlSlip:
+			msg = slipReply(r)
+			answer += "\n(RRL slip)"
+			logged = rrlShouldLog()
+		}
+	}
+	if logged {
+		for _, record := range records {
+			record.Answer = answer
+			record.Ttl = ttl
 			InsertRecord(record)
-			switch q.Qtype {
-			case dns.TypeA:
-				rr := &dns.A{
-					Hdr: dns.RR_Header{
-						Name:   q.Name,
-						Rrtype: q.Qtype,
-						Class:  dns.ClassINET,
-						Ttl:    uint32(ttl),
-					},
-					A: net.ParseIP(defaultip),
-				}
-				msg.Answer = append(msg.Answer, rr)
-			}
 		}
 	}
+	return msg, delay
+}
 
-	// 发送响应
-	w.WriteMsg(&msg)
+// listenAddrs 返回某个协议的监听地址, 未配置时默认 :53
+func listenAddrs(addrs []string) []string {
+	if len(addrs) == 0 {
+		return []string{":53"}
+	}
+	return addrs
 }
 
 func Start() error {
 	logrus.Info("start dns server ")
+	if err := ReloadRules(); err != nil {
+		logrus.Errorf("load dns rules: %v", err)
+	}
+	go refreshRules()
+	if config.GetBase().Dns.Acme.Enabled {
+		if err := ReloadAcmeTxt(); err != nil {
+			logrus.Errorf("load acme txt: %v", err)
+		}
+		go refreshAcmeTxt()
+	}
+	if n, err := ReloadResolvers(); err != nil {
+		logrus.Errorf("load resolvers: %v", err)
+	} else {
+		logrus.Infof("loaded %d resolver ranges", n)
+	}
+	go watchResolvers()
+	if config.GetBase().Dns.Dnssec.Enabled {
+		for _, name := range ZoneNames() {
+			if err := LoadDnssecKeys(name); err != nil {
+				log.Fatalf("无法加载 %s 的 DNSSEC 密钥: %v\n", name, err)
+			}
+		}
+	}
+	startWorkers()
+	go cleanupRRL()
 
-	dns.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
-		go handleDNSRequest(w, r) // 使用 goroutine 处理每个请求
-	})
-	server := &dns.Server{Addr: ":53", Net: "udp"}
-	log.Printf("启动 DNS 服务器，监听 %s\n", server.Addr)
-	err := server.ListenAndServe()
+	var servers []*dns.Server
+	for _, addr := range listenAddrs(config.GetBase().Dns.Listen.Udp) {
+		servers = append(servers, &dns.Server{Addr: addr, Net: "udp", Handler: dnsHandler(TransportUDP)})
+	}
+	for _, addr := range listenAddrs(config.GetBase().Dns.Listen.Tcp) {
+		servers = append(servers, &dns.Server{Addr: addr, Net: "tcp", IdleTimeout: tcpIdleTimeout, Handler: dnsHandler(TransportTCP)})
+	}
+	dotServers, err := dotServers()
+	if err != nil {
+		log.Fatalf("无法启动 DoT 服务器: %v\n", err)
+	}
+	servers = append(servers, dotServers...)
+
+	errCh := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *dns.Server) {
+			log.Printf("启动 DNS 服务器，监听 %s/%s\n", server.Addr, server.Net)
+			errCh <- server.ListenAndServe()
+		}(server)
+	}
+	err = <-errCh
 	if err != nil {
 		log.Fatalf("无法启动 DNS 服务器: %v\n", err)
 	}
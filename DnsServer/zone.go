@@ -0,0 +1,216 @@
+package DnsServer
+
+import (
+	"bflog/config"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// startSerial 未配置 serial 时使用启动时间, 保证每次重启后递增
+var startSerial = uint32(time.Now().Unix())
+
+// zone 一个权威区域, name 统一为小写并以点结尾
+type zone struct {
+	name string
+	cfg  config.ZoneConfig
+}
+
+// zoneTable 由配置生成的全部权威区域 []*zone, 每次设置配置时重建
+var zoneTable atomic.Value
+
+func init() {
+	config.OnSetBase(loadZones)
+}
+
+// loadZones 按当前配置重建区域列表
+func loadZones() {
+	var list []*zone
+	for _, cfg := range config.GetZones() {
+		if strings.TrimSpace(cfg.Name) == "" {
+			continue
+		}
+		list = append(list, &zone{name: dns.Fqdn(strings.ToLower(cfg.Name)), cfg: cfg})
+	}
+	zoneTable.Store(list)
+}
+
+// zones 返回配置的全部权威区域
+func zones() []*zone {
+	list, _ := zoneTable.Load().([]*zone)
+	return list
+}
+
+// findZone 返回包含该名称的最长的区域, 不属于任何区域时返回 nil
+func findZone(name string) *zone {
+	name = strings.ToLower(dns.Fqdn(name))
+	var matched *zone
+	for _, z := range zones() {
+		if dns.IsSubDomain(z.name, name) && (matched == nil || len(z.name) > len(matched.name)) {
+			matched = z
+		}
+	}
+	return matched
+}
+
+// primaryZone 配置中的第一个区域, 用于只需要一个区域的功能
+func primaryZone() *zone {
+	if list := zones(); len(list) > 0 {
+		return list[0]
+	}
+	return &zone{name: "."}
+}
+
+// ZoneNames 返回全部区域名, 以点结尾
+func ZoneNames() []string {
+	var names []string
+	for _, z := range zones() {
+		names = append(names, z.name)
+	}
+	return names
+}
+
+// defaultTTL 未命中规则的名称以及没有设置 TTL 的规则使用的 TTL
+func (z *zone) defaultTTL() uint32 {
+	if z.cfg.Ttl == nil {
+		return 60
+	}
+	return *z.cfg.Ttl
+}
+
+// outOfZoneRcode 区域外查询的响应码
+func outOfZoneRcode() int {
+	if strings.EqualFold(config.GetBase().Dns.OutOfZone, "nxdomain") {
+		return dns.RcodeNameError
+	}
+	return dns.RcodeRefused
+}
+
+func (z *zone) soaRecord() *dns.SOA {
+	cfg := z.cfg.Soa
+	soa := &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   z.name,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    valueOr(cfg.Ttl, 3600),
+		},
+		Ns:      dns.Fqdn(cfg.Mname),
+		Mbox:    dns.Fqdn(cfg.Rname),
+		Serial:  valueOr(cfg.Serial, startSerial),
+		Refresh: valueOr(cfg.Refresh, 3600),
+		Retry:   valueOr(cfg.Retry, 600),
+		Expire:  valueOr(cfg.Expire, 86400),
+		Minttl:  60,
+	}
+	if cfg.Minttl != nil {
+		soa.Minttl = *cfg.Minttl
+	}
+	if cfg.Mname == "" {
+		soa.Ns = "ns1." + z.name
+	}
+	if cfg.Rname == "" {
+		soa.Mbox = "hostmaster." + z.name
+	}
+	return soa
+}
+
+// negativeSOA 否定应答中放在 authority 段的 SOA, TTL 取 SOA TTL 与 minttl 的较小值
+func (z *zone) negativeSOA() *dns.SOA {
+	soa := z.soaRecord()
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	return soa
+}
+
+// nameServers 返回区域的 NS 列表, 未配置时使用 ns1/ns2 加区域的默认地址
+func (z *zone) nameServers() []config.NsConfig {
+	if len(z.cfg.Ns) > 0 {
+		return z.cfg.Ns
+	}
+	return []config.NsConfig{
+		{Name: "ns1." + z.name, Ipv4: z.cfg.DefaultIp},
+		{Name: "ns2." + z.name, Ipv4: z.cfg.DefaultIp},
+	}
+}
+
+func (z *zone) nsRecords() []dns.RR {
+	ttl := valueOr(z.cfg.Soa.Ttl, 3600)
+	var records []dns.RR
+	for _, ns := range z.nameServers() {
+		records = append(records, &dns.NS{
+			Hdr: dns.RR_Header{Name: z.name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: ttl},
+			Ns:  dns.Fqdn(ns.Name),
+		})
+	}
+	return records
+}
+
+// glueRecords 返回名称服务器的地址记录, qtype 为 0 时同时返回 A 和 AAAA
+func (z *zone) glueRecords(name string, qtype uint16) []dns.RR {
+	ttl := valueOr(z.cfg.Soa.Ttl, 3600)
+	var records []dns.RR
+	for _, ns := range z.nameServers() {
+		if !strings.EqualFold(dns.Fqdn(ns.Name), name) {
+			continue
+		}
+		hdr := dns.RR_Header{Name: dns.Fqdn(ns.Name), Class: dns.ClassINET, Ttl: ttl}
+		if ip := net.ParseIP(ns.Ipv4); ip != nil && (qtype == 0 || qtype == dns.TypeA) {
+			hdr.Rrtype = dns.TypeA
+			records = append(records, &dns.A{Hdr: hdr, A: ip.To4()})
+		}
+		if ip := net.ParseIP(ns.Ipv6); ip != nil && (qtype == 0 || qtype == dns.TypeAAAA) {
+			hdr.Rrtype = dns.TypeAAAA
+			records = append(records, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return records
+}
+
+// isNameServer 判断域名是否为区域配置的名称服务器
+func (z *zone) isNameServer(name string) bool {
+	for _, ns := range z.nameServers() {
+		if strings.EqualFold(dns.Fqdn(ns.Name), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorityAnswer 处理区域自身的 SOA/NS 以及名称服务器地址查询, 其他查询返回 false
+func (z *zone) authorityAnswer(msg *dns.Msg, q dns.Question) bool {
+	name := strings.ToLower(q.Name)
+	if name == z.name {
+		switch q.Qtype {
+		case dns.TypeSOA:
+			msg.Answer = append(msg.Answer, z.soaRecord())
+			return true
+		case dns.TypeNS:
+			msg.Answer = append(msg.Answer, z.nsRecords()...)
+			for _, ns := range z.nameServers() {
+				msg.Extra = append(msg.Extra, z.glueRecords(dns.Fqdn(ns.Name), 0)...)
+			}
+			return true
+		case dns.TypeDNSKEY:
+			if dnssecEnabled() {
+				msg.Answer = append(msg.Answer, dnskeyRecords(z.name)...)
+			}
+			return true
+		}
+	}
+	if z.isNameServer(name) {
+		msg.Answer = append(msg.Answer, z.glueRecords(name, q.Qtype)...)
+		return true
+	}
+	return false
+}
+
+func valueOr(value uint32, def uint32) uint32 {
+	if value == 0 {
+		return def
+	}
+	return value
+}
@@ -0,0 +1,40 @@
+package DnsServer
+
+import (
+	"bflog/config"
+	"testing"
+)
+
+func TestNegativeSOAMinttl(t *testing.T) {
+	zero, five := uint32(0), uint32(5)
+	cfg := &config.Config{}
+	cfg.Dns.Soa = config.SoaConfig{Ttl: 3600, Minttl: &five}
+	cfg.Dns.Zones = []config.ZoneConfig{
+		{Name: "inherit.test"},
+		{Name: "zero.test", Soa: config.SoaConfig{Minttl: &zero}},
+	}
+	config.SetBase(cfg)
+	t.Cleanup(func() { config.SetBase(nil) })
+
+	tests := []struct {
+		name   string
+		minttl uint32
+	}{
+		// 区域未设置时沿用全局的 minttl
+		{"a.inherit.test.", 5},
+		// 0 表示不缓存否定应答, 不会被当成未设置
+		{"a.zero.test.", 0},
+	}
+	for _, tt := range tests {
+		soa := findZone(tt.name).negativeSOA()
+		if soa.Minttl != tt.minttl || soa.Hdr.Ttl != tt.minttl {
+			t.Errorf("%s: minttl = %d, ttl = %d, want %d", tt.name, soa.Minttl, soa.Hdr.Ttl, tt.minttl)
+		}
+	}
+
+	cfg.Dns.Soa.Minttl = nil
+	config.SetBase(cfg)
+	if soa := findZone("a.inherit.test.").negativeSOA(); soa.Minttl != 60 {
+		t.Errorf("unset minttl = %d, want 60", soa.Minttl)
+	}
+}
@@ -0,0 +1,210 @@
+package DnsServer
+
+import (
+	"bflog/db"
+	"bufio"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ZoneImportResult 导入区域文件的结果, Applied 为 false 时只是预览, 没有写入数据库
+type ZoneImportResult struct {
+	Applied   bool         `json:"applied"`
+	Created   []db.DnsRule `json:"created"`
+	Updated   []db.DnsRule `json:"updated"`
+	Unchanged int          `json:"unchanged"`
+	// Skipped 按设计不导入的记录以及原因, 例如 SOA/NS 和不支持的类型
+	Skipped []string `json:"skipped"`
+}
+
+// zoneFileRules 用 dns.ZoneParser 解析 RFC 1035 主文件, 同名同类型的记录合并成一条规则.
+// SOA/NS 由配置文件管理, 其他不支持的类型以及不属于任何区域的名称都放进 skipped
+func zoneFileRules(r io.Reader, origin string) ([]db.DnsRule, []string, error) {
+	var rules []db.DnsRule
+	var skipped []string
+	index := make(map[string]int)
+	zp := dns.NewZoneParser(r, dns.Fqdn(origin), "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		hdr := rr.Header()
+		rtype := dns.TypeToString[hdr.Rrtype]
+		if findZone(hdr.Name) == nil {
+			skipped = append(skipped, fmt.Sprintf("%s: 不属于任何区域", rr.String()))
+			continue
+		}
+		var value string
+		switch v := rr.(type) {
+		case *dns.A:
+			value = v.A.String()
+		case *dns.AAAA:
+			value = v.AAAA.String()
+		case *dns.CNAME:
+			value = removeTrailingDot(v.Target)
+		case *dns.MX:
+			value = fmt.Sprintf("%d %s", v.Preference, removeTrailingDot(v.Mx))
+		case *dns.TXT:
+			value = strings.Join(v.Txt, "")
+		case *dns.SOA, *dns.NS:
+			skipped = append(skipped, fmt.Sprintf("%s: SOA/NS 由配置文件管理", rr.String()))
+			continue
+		default:
+			skipped = append(skipped, fmt.Sprintf("%s: 不支持的记录类型", rr.String()))
+			continue
+		}
+		name := strings.ToLower(removeTrailingDot(hdr.Name))
+		key := db.DnsRuleKey(name, rtype)
+		if i, ok := index[key]; ok {
+			rules[i].IPAddresses = append(rules[i].IPAddresses, value)
+			continue
+		}
+		index[key] = len(rules)
+		ttl := hdr.Ttl
+		rules = append(rules, db.DnsRule{Name: name, Type: rtype, IPAddresses: db.DnsRuleValues{value}, Ttl: &ttl})
+	}
+	if err := zp.Err(); err != nil {
+		return nil, nil, err
+	}
+	return rules, skipped, nil
+}
+
+// canonicalValue 统一记录值中不区分大小写的部分: 域名小写并去掉末尾的点, IPv6 地址使用标准写法.
+// TXT 等其他记录的数据区分大小写, 原样比较
+func canonicalValue(rtype string, value string) string {
+	switch rtype {
+	case "A", "AAAA":
+		if ip := net.ParseIP(value); ip != nil {
+			return ip.String()
+		}
+	case "CNAME", "MX":
+		return strings.ToLower(removeTrailingDot(value))
+	}
+	return value
+}
+
+// sameValues 比较两组记录值, 忽略顺序和空白
+func sameValues(rtype string, a db.DnsRuleValues, b db.DnsRuleValues) bool {
+	canonical := func(values db.DnsRuleValues) []string {
+		result := values.Trimmed()
+		for i, v := range result {
+			result[i] = canonicalValue(rtype, v)
+		}
+		sort.Strings(result)
+		return result
+	}
+	return reflect.DeepEqual(canonical(a), canonical(b))
+}
+
+// ImportZoneFile 把区域文件转换成规则并与现有规则比较, apply 为 true 时写入数据库并刷新规则表.
+// 已存在的同名同类型规则只更新记录值和 TTL, 保留 rebinding 策略等其他设置
+func ImportZoneFile(r io.Reader, origin string, apply bool) (*ZoneImportResult, error) {
+	if origin == "" {
+		origin = primaryZone().name
+	}
+	rules, skipped, err := zoneFileRules(r, origin)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := db.GetDB().GetAllDnsRules()
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[string]db.DnsRule, len(existing))
+	for _, rule := range existing {
+		current[db.DnsRuleKey(strings.ToLower(removeTrailingDot(rule.Name)), rule.Type)] = rule
+	}
+	result := &ZoneImportResult{Created: []db.DnsRule{}, Updated: []db.DnsRule{}, Skipped: skipped}
+	for _, rule := range rules {
+		old, ok := current[db.DnsRuleKey(rule.Name, rule.Type)]
+		switch {
+		case !ok:
+			result.Created = append(result.Created, rule)
+		case sameValues(rule.Type, old.IPAddresses, rule.IPAddresses) && old.Ttl != nil && *old.Ttl == *rule.Ttl:
+			result.Unchanged++
+		default:
+			old.IPAddresses = rule.IPAddresses
+			old.Ttl = rule.Ttl
+			result.Updated = append(result.Updated, old)
+		}
+	}
+	if !apply {
+		return result, nil
+	}
+	if err := db.GetDB().SaveDnsRules(result.Created, result.Updated); err != nil {
+		return nil, err
+	}
+	result.Applied = true
+	if err := ReloadRules(); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// exportTTL 导出时使用规则实际应答的 TTL
+func exportTTL(rule db.DnsRule, rtype string, name string) uint32 {
+	if rule.Ttl != nil {
+		return *rule.Ttl
+	}
+	z := findZone(name)
+	if z == nil {
+		return 0
+	}
+	rule.Type = rtype
+	return ruleTTL(&ruleEntry{rule: rule, values: rule.IPAddresses.Trimmed()}, z)
+}
+
+// ExportZoneFile 把当前规则导出为区域文件, origin 不为空时只导出该区域内的规则.
+// 正则规则无法用主文件表示, 以注释的形式输出; rebinding 策略也写在注释中
+func ExportZoneFile(w io.Writer, origin string) error {
+	rules, err := db.GetDB().GetAllDnsRules()
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].Name != rules[j].Name {
+			return rules[i].Name < rules[j].Name
+		}
+		return rules[i].Type < rules[j].Type
+	})
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "; exported by bflog at %s\n", time.Now().Format(time.RFC3339))
+	if origin != "" {
+		origin = dns.Fqdn(strings.ToLower(origin))
+		fmt.Fprintf(bw, "$ORIGIN %s\n", origin)
+	}
+	for _, rule := range rules {
+		rtype := strings.ToUpper(rule.Type)
+		if rtype == "" {
+			rtype = "A"
+		}
+		if RuleMatchType(rule) == MatchRegex {
+			fmt.Fprintf(bw, "; regex rule %s %s %q\n", strconv.Quote(rule.Name), rtype, []string(rule.IPAddresses))
+			continue
+		}
+		name := dns.Fqdn(strings.ToLower(rule.Name))
+		if origin != "" && !dns.IsSubDomain(origin, name) {
+			continue
+		}
+		if rule.Strategy != "" {
+			fmt.Fprintf(bw, "; strategy=%s strategy_arg=%d\n", rule.Strategy, rule.StrategyArg)
+		}
+		if rule.Probe != "" {
+			fmt.Fprintf(bw, "; probe=%s probe_arg=%d\n", rule.Probe, rule.ProbeArg)
+		}
+		ttl := exportTTL(rule, rtype, name)
+		for _, value := range rule.IPAddresses.Trimmed() {
+			rr, err := newRR(name, dns.StringToType[rtype], value, ttl)
+			if err != nil {
+				fmt.Fprintf(bw, "; invalid %s %s %s: %v\n", name, rtype, value, err)
+				continue
+			}
+			fmt.Fprintln(bw, rr.String())
+		}
+	}
+	return bw.Flush()
+}
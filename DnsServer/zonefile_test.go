@@ -0,0 +1,82 @@
+package DnsServer
+
+import (
+	"bflog/config"
+	"bflog/db"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSameValues(t *testing.T) {
+	tests := []struct {
+		rtype string
+		a, b  db.DnsRuleValues
+		want  bool
+	}{
+		{"A", db.DnsRuleValues{"1.2.3.4", "5.6.7.8"}, db.DnsRuleValues{" 5.6.7.8 ", "1.2.3.4", ""}, true},
+		{"A", db.DnsRuleValues{"1.2.3.4"}, db.DnsRuleValues{"1.2.3.5"}, false},
+		{"AAAA", db.DnsRuleValues{"2001:DB8::1"}, db.DnsRuleValues{"2001:db8:0::1"}, true},
+		{"CNAME", db.DnsRuleValues{"Target.Example.com."}, db.DnsRuleValues{"target.example.com"}, true},
+		{"MX", db.DnsRuleValues{"10 MX.example.com"}, db.DnsRuleValues{"10 mx.example.com"}, true},
+		{"MX", db.DnsRuleValues{"10 mx.example.com"}, db.DnsRuleValues{"20 mx.example.com"}, false},
+		// TXT 只有大小写不同也是修改
+		{"TXT", db.DnsRuleValues{"v=spf1 -all"}, db.DnsRuleValues{"V=SPF1 -ALL"}, false},
+		{"TXT", db.DnsRuleValues{"token-AbC"}, db.DnsRuleValues{"token-AbC"}, true},
+		// 含逗号的 TXT 是一个值
+		{"TXT", db.DnsRuleValues{"a,b"}, db.DnsRuleValues{"a", "b"}, false},
+	}
+	for _, tt := range tests {
+		if got := sameValues(tt.rtype, tt.a, tt.b); got != tt.want {
+			t.Errorf("sameValues(%s, %q, %q) = %t, want %t", tt.rtype, tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestZoneFileRules(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Server.Subdomain = "dnslog.test"
+	config.SetBase(cfg)
+	t.Cleanup(func() { config.SetBase(nil) })
+
+	zone := `$TTL 300
+@        IN SOA ns1 hostmaster 1 3600 600 86400 60
+WWW      IN A     192.0.2.1
+www      IN A     192.0.2.2
+alias 60 IN CNAME Www.dnslog.test.
+txt      IN TXT   "Mixed" "Case"
+comma    IN TXT   "a,b"
+comma    IN TXT   "c"
+other.example. IN A 192.0.2.3
+srv      IN SRV   0 0 443 www
+`
+	rules, skipped, err := zoneFileRules(strings.NewReader(zone), "dnslog.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		name, rtype string
+		values      db.DnsRuleValues
+		ttl         uint32
+	}{
+		{"www.dnslog.test", "A", db.DnsRuleValues{"192.0.2.1", "192.0.2.2"}, 300},
+		{"alias.dnslog.test", "CNAME", db.DnsRuleValues{"Www.dnslog.test"}, 60},
+		{"txt.dnslog.test", "TXT", db.DnsRuleValues{"MixedCase"}, 300},
+		// 含逗号的 TXT 原样保存为一个值
+		{"comma.dnslog.test", "TXT", db.DnsRuleValues{"a,b", "c"}, 300},
+	}
+	if len(rules) != len(want) {
+		t.Fatalf("got %d rules, want %d: %+v", len(rules), len(want), rules)
+	}
+	for i, w := range want {
+		rule := rules[i]
+		if rule.Name != w.name || rule.Type != w.rtype || !reflect.DeepEqual(rule.IPAddresses, w.values) || *rule.Ttl != w.ttl {
+			t.Errorf("rule %d = %s %s %q %d, want %s %s %q %d",
+				i, rule.Name, rule.Type, []string(rule.IPAddresses), *rule.Ttl, w.name, w.rtype, []string(w.values), w.ttl)
+		}
+	}
+	// SOA, 区域外的名称和不支持的 SRV 跳过
+	if len(skipped) != 3 {
+		t.Errorf("skipped = %q", skipped)
+	}
+}
@@ -0,0 +1,88 @@
+package HttpServer
+
+import (
+	"bflog/DnsServer"
+	"bflog/config"
+	"encoding/base64"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const dnsMessageType = "application/dns-message"
+
+// dohPath 返回 DoH 接口路径, 默认 /dns-query
+func dohPath() string {
+	if path := config.GetBase().Dns.Doh.Path; path != "" {
+		return path
+	}
+	return "/dns-query"
+}
+
+// dohHandler 实现 RFC 8484 的 GET(?dns=) 和 POST(application/dns-message) 两种请求方式
+func dohHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var raw []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		raw, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(r.URL.Query().Get("dns"), "="))
+	case http.MethodPost:
+		// 允许带参数, 例如 application/dns-message; charset=utf-8
+		if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != dnsMessageType {
+			http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+			return
+		}
+		raw, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil || len(raw) == 0 {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	req := new(dns.Msg)
+	if err := req.Unpack(raw); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	// 与普通 HTTP 请求一样, 取不到客户端地址时拒绝
+	remoteAddr, ok := requestAddr(r)
+	if !ok {
+		http.Error(w, "Cannot read client address", http.StatusInternalServerError)
+		return
+	}
+	resp := DnsServer.HandleDNSMessage(req, remoteAddr, DnsServer.TransportDoH)
+	if resp == nil {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	out, err := resp.Pack()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", dnsMessageType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", minTTL(resp)))
+	_, _ = w.Write(out)
+}
+
+// minTTL 返回应答中最小的 TTL, 作为 HTTP 缓存时间
+func minTTL(msg *dns.Msg) uint32 {
+	var ttl uint32
+	first := true
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns} {
+		for _, rr := range section {
+			if first || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				first = false
+			}
+		}
+	}
+	return ttl
+}
@@ -0,0 +1,91 @@
+package HttpServer
+
+import (
+	"bflog/config"
+	"bflog/db"
+	"bytes"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// setupDoh 使用一个区域的配置, 返回 dnslog 记录的通道
+func setupDoh(t *testing.T, nginx int) chan db.Dnslog {
+	t.Helper()
+	cfg := &config.Config{Nginx: nginx}
+	cfg.Dns.Zones = []config.ZoneConfig{{Name: "dnslog.test", DefaultIp: "192.0.2.10"}}
+	config.SetBase(cfg)
+	ch := make(chan db.Dnslog, 10)
+	db.SetDB(&db.DBClient{InsertCh: ch})
+	t.Cleanup(func() {
+		config.SetBase(nil)
+		db.SetDB(nil)
+	})
+	return ch
+}
+
+func dohRequest(t *testing.T, contentType string, realIP string) *httptest.ResponseRecorder {
+	t.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion("a.dnslog.test.", dns.TypeA)
+	raw, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "http://dnslog.test/dns-query", bytes.NewReader(raw))
+	r.Header.Set("Content-Type", contentType)
+	if realIP != "" {
+		r.Header.Set("X-Real-Ip", realIP)
+	}
+	w := httptest.NewRecorder()
+	dohHandler(w, r)
+	return w
+}
+
+func TestDohContentType(t *testing.T) {
+	setupDoh(t, 0)
+	tests := []struct {
+		contentType string
+		status      int
+	}{
+		{"application/dns-message", http.StatusOK},
+		{"application/dns-message; charset=utf-8", http.StatusOK},
+		{"Application/DNS-Message", http.StatusOK},
+		{"application/json", http.StatusUnsupportedMediaType},
+		{"", http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		w := dohRequest(t, tt.contentType, "")
+		if w.Code != tt.status {
+			t.Errorf("%q: status = %d, want %d", tt.contentType, w.Code, tt.status)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		resp := new(dns.Msg)
+		if err := resp.Unpack(w.Body.Bytes()); err != nil || len(resp.Answer) != 1 {
+			t.Errorf("%q: response %v, err %v", tt.contentType, resp, err)
+		}
+	}
+}
+
+func TestDohRealIP(t *testing.T) {
+	ch := setupDoh(t, 1)
+	// 经过 Nginx 时与普通 HTTP 请求一样, 缺少 X-Real-Ip 的请求被拒绝
+	for _, realIP := range []string{"", "-"} {
+		if w := dohRequest(t, dnsMessageType, realIP); w.Code != http.StatusInternalServerError {
+			t.Errorf("X-Real-Ip %q: status = %d", realIP, w.Code)
+		}
+	}
+	if len(ch) != 0 {
+		t.Fatalf("%d records logged for rejected requests", len(ch))
+	}
+	if w := dohRequest(t, dnsMessageType, "198.51.100.7, 10.0.0.1"); w.Code != http.StatusOK {
+		t.Fatalf("status = %d", w.Code)
+	}
+	if record := <-ch; record.ReceiveIP != "198.51.100.7" {
+		t.Errorf("receive ip = %q", record.ReceiveIP)
+	}
+}
@@ -0,0 +1,462 @@
+package HttpServer
+
+import (
+	"bflog/db"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLS 握手记录和扩展的类型
+const (
+	recordTypeHandshake      = 22
+	handshakeTypeClientHello = 1
+
+	extServerName        = 0x0000
+	extSupportedGroups   = 0x000a
+	extPointFormats      = 0x000b
+	extSignatureAlgs     = 0x000d
+	extALPN              = 0x0010
+	extSupportedVersions = 0x002b
+)
+
+// maxHelloSize ClientHello 的最大长度, 超过时放弃解析
+const maxHelloSize = 64 << 10
+
+var (
+	errNotTLS          = errors.New("not a tls handshake")
+	errIncompleteHello = errors.New("incomplete client hello")
+	errMalformedHello  = errors.New("malformed client hello")
+)
+
+// clientHello ClientHello 中用于指纹的字段, 保持客户端发送的顺序
+type clientHello struct {
+	Version       uint16
+	Ciphers       []uint16
+	Extensions    []uint16
+	Curves        []uint16
+	Points        []uint8
+	SignatureAlgs []uint16
+	Versions      []uint16
+	ServerName    string
+	ALPN          []string
+}
+
+// isGrease 判断是否为 RFC 8701 的 GREASE 值, 计算指纹时忽略
+func isGrease(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGrease(values []uint16) []uint16 {
+	out := make([]uint16, 0, len(values))
+	for _, v := range values {
+		if !isGrease(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// helloMessage 从连接开头的 TLS 记录中拼出 ClientHello 握手消息, 数据不够时返回 errIncompleteHello
+func helloMessage(data []byte) ([]byte, error) {
+	var msg []byte
+	for len(data) > 0 {
+		if data[0] != recordTypeHandshake {
+			return nil, errNotTLS
+		}
+		if len(data) < 5 {
+			return nil, errIncompleteHello
+		}
+		n := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < 5+n {
+			msg = append(msg, data[5:]...)
+			break
+		}
+		msg = append(msg, data[5:5+n]...)
+		data = data[5+n:]
+		if len(msg) >= 4 && len(msg) >= 4+int(msg[1])<<16|int(msg[2])<<8|int(msg[3]) {
+			break
+		}
+	}
+	if len(msg) < 4 {
+		return nil, errIncompleteHello
+	}
+	if msg[0] != handshakeTypeClientHello {
+		return nil, errMalformedHello
+	}
+	n := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+	if len(msg) < 4+n {
+		return nil, errIncompleteHello
+	}
+	return msg[4 : 4+n], nil
+}
+
+// helloReader 按大端序读取 ClientHello 中的字段, 越界后 ok 为 false
+type helloReader struct {
+	data []byte
+	ok   bool
+}
+
+func (r *helloReader) bytes(n int) []byte {
+	if !r.ok || n > len(r.data) {
+		r.ok = false
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *helloReader) uint8() int {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])
+}
+
+func (r *helloReader) uint16() int {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(b))
+}
+
+// vector 读取一个长度前缀为 lenBytes 字节的字段
+func (r *helloReader) vector(lenBytes int) *helloReader {
+	var n int
+	if lenBytes == 1 {
+		n = r.uint8()
+	} else {
+		n = r.uint16()
+	}
+	return &helloReader{data: r.bytes(n), ok: r.ok}
+}
+
+func (r *helloReader) uint16s() []uint16 {
+	var values []uint16
+	for r.ok && len(r.data) >= 2 {
+		values = append(values, uint16(r.uint16()))
+	}
+	return values
+}
+
+// parseClientHello 解析连接开头的原始数据
+func parseClientHello(data []byte) (*clientHello, error) {
+	body, err := helloMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	r := &helloReader{data: body, ok: true}
+	hello := &clientHello{Version: uint16(r.uint16())}
+	r.bytes(32)
+	r.vector(1)
+	hello.Ciphers = r.vector(2).uint16s()
+	r.vector(1)
+	if !r.ok {
+		return nil, errMalformedHello
+	}
+	// 没有任何扩展的 ClientHello (例如老的 SSLv3/TLS 1.0 客户端) 在压缩方法之后直接结束
+	exts := &helloReader{ok: true}
+	if len(r.data) > 0 {
+		exts = r.vector(2)
+	}
+	for exts.ok && len(exts.data) >= 4 {
+		typ := uint16(exts.uint16())
+		ext := exts.vector(2)
+		hello.Extensions = append(hello.Extensions, typ)
+		switch typ {
+		case extServerName:
+			list := ext.vector(2)
+			for list.ok && len(list.data) >= 3 {
+				nameType := list.uint8()
+				name := list.vector(2)
+				if nameType == 0 && name.ok {
+					hello.ServerName = string(name.data)
+				}
+			}
+		case extSupportedGroups:
+			hello.Curves = ext.vector(2).uint16s()
+		case extPointFormats:
+			hello.Points = ext.vector(1).data
+		case extSignatureAlgs:
+			hello.SignatureAlgs = ext.vector(2).uint16s()
+		case extALPN:
+			list := ext.vector(2)
+			for list.ok && len(list.data) > 0 {
+				if proto := list.vector(1); proto.ok {
+					hello.ALPN = append(hello.ALPN, string(proto.data))
+				}
+			}
+		case extSupportedVersions:
+			hello.Versions = ext.vector(1).uint16s()
+		}
+	}
+	if !exts.ok {
+		return nil, errMalformedHello
+	}
+	return hello, nil
+}
+
+// maxVersion 返回客户端支持的最高版本, 没有 supported_versions 扩展时为 ClientHello 中的版本
+func (h *clientHello) maxVersion() uint16 {
+	version := h.Version
+	for _, v := range withoutGrease(h.Versions) {
+		if v > version {
+			version = v
+		}
+	}
+	return version
+}
+
+func joinDecimal(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(parts, "-")
+}
+
+// JA3 返回 JA3 字符串: 版本,加密套件,扩展,椭圆曲线,点格式
+func (h *clientHello) JA3() string {
+	points := make([]string, len(h.Points))
+	for i, p := range h.Points {
+		points[i] = strconv.Itoa(int(p))
+	}
+	return fmt.Sprintf("%d,%s,%s,%s,%s", h.Version,
+		joinDecimal(withoutGrease(h.Ciphers)), joinDecimal(withoutGrease(h.Extensions)),
+		joinDecimal(withoutGrease(h.Curves)), strings.Join(points, "-"))
+}
+
+// JA3Hash 返回 JA3 字符串的 MD5
+func (h *clientHello) JA3Hash() string {
+	sum := md5.Sum([]byte(h.JA3()))
+	return hex.EncodeToString(sum[:])
+}
+
+var ja4Versions = map[uint16]string{0x0304: "13", 0x0303: "12", 0x0302: "11", 0x0301: "10", 0x0300: "s3"}
+
+func joinHex(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(parts, ",")
+}
+
+// ja4Hash 取 SHA256 的前 12 个十六进制字符, 列表为空时为 12 个 0
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func isAlnum(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// ja4ALPN 第一个 ALPN 的首尾字符, 不是字母数字时使用十六进制的首尾字符
+func (h *clientHello) ja4ALPN() string {
+	if len(h.ALPN) == 0 || h.ALPN[0] == "" {
+		return "00"
+	}
+	proto := h.ALPN[0]
+	first, last := proto[0], proto[len(proto)-1]
+	if isAlnum(first) && isAlnum(last) {
+		return string([]byte{first, last})
+	}
+	s := hex.EncodeToString([]byte(proto))
+	return string([]byte{s[0], s[len(s)-1]})
+}
+
+// JA4 返回 TCP 上的 JA4 指纹, 例如 t13d1516h2_8daaf6152771_02713d6af862
+func (h *clientHello) JA4() string {
+	version, ok := ja4Versions[h.maxVersion()]
+	if !ok {
+		version = "00"
+	}
+	sni := "i"
+	if h.ServerName != "" {
+		sni = "d"
+	}
+	ciphers := withoutGrease(h.Ciphers)
+	extensions := withoutGrease(h.Extensions)
+	a := fmt.Sprintf("t%s%s%02d%02d%s", version, sni, min(len(ciphers), 99), min(len(extensions), 99), h.ja4ALPN())
+
+	sortedCiphers := append([]uint16(nil), ciphers...)
+	sort.Slice(sortedCiphers, func(i, j int) bool { return sortedCiphers[i] < sortedCiphers[j] })
+
+	var sortedExts []uint16
+	for _, ext := range extensions {
+		if ext != extServerName && ext != extALPN {
+			sortedExts = append(sortedExts, ext)
+		}
+	}
+	sort.Slice(sortedExts, func(i, j int) bool { return sortedExts[i] < sortedExts[j] })
+	c := joinHex(sortedExts)
+	if sigs := withoutGrease(h.SignatureAlgs); len(sigs) > 0 {
+		c += "_" + joinHex(sigs)
+	}
+	return a + "_" + ja4Hash(joinHex(sortedCiphers)) + "_" + ja4Hash(c)
+}
+
+// helloListener 记录每个连接开头的 ClientHello
+type helloListener struct {
+	net.Listener
+}
+
+func (l *helloListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &helloConn{Conn: conn, accepted: time.Now()}, nil
+}
+
+// helloConn 在握手期间复制读到的数据, 解析出 ClientHello 后停止复制.
+// 连接关闭时握手还没有完成的, 也会记录一条只有指纹的日志
+type helloConn struct {
+	net.Conn
+	accepted time.Time
+
+	mu      sync.Mutex
+	buf     []byte
+	done    bool
+	hello   *clientHello
+	err     error
+	tlsConn *tls.Conn
+	closed  bool
+}
+
+func (c *helloConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.mu.Lock()
+		if !c.done {
+			c.buf = append(c.buf, p[:n]...)
+			c.hello, c.err = parseClientHello(c.buf)
+			if c.err != errIncompleteHello || len(c.buf) > maxHelloSize {
+				c.done, c.buf = true, nil
+			}
+		}
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+// clientHello 返回解析出的 ClientHello 以及解析失败的原因
+func (c *helloConn) clientHello() (*clientHello, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hello, c.err
+}
+
+func (c *helloConn) Close() error {
+	// 先关闭底层连接, 让进行中的握手返回, 再查看握手状态
+	err := c.Conn.Close()
+	c.mu.Lock()
+	first := !c.closed
+	c.closed = true
+	tlsConn, received := c.tlsConn, c.hello != nil || c.err != nil
+	c.mu.Unlock()
+	if first && received && tlsConn != nil && !tlsConn.ConnectionState().HandshakeComplete {
+		go logHandshakeFailure(c)
+	}
+	return err
+}
+
+type helloContextKey struct{}
+
+// helloConnContext 把连接保存到请求的 context 中, 处理请求时再取出 ClientHello
+func helloConnContext(ctx context.Context, conn net.Conn) context.Context {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ctx
+	}
+	hc, ok := tlsConn.NetConn().(*helloConn)
+	if !ok {
+		return ctx
+	}
+	hc.mu.Lock()
+	hc.tlsConn = tlsConn
+	hc.mu.Unlock()
+	return context.WithValue(ctx, helloContextKey{}, hc)
+}
+
+// applyTLSInfo 把 ClientHello 中的 SNI, ALPN, 加密套件和指纹填到日志中, state 不为空时使用协商出的版本
+func applyTLSInfo(log *db.HttpRequestLog, hello *clientHello, state *tls.ConnectionState) {
+	if hello != nil {
+		log.Sni = hello.ServerName
+		log.Alpn = strings.Join(hello.ALPN, ",")
+		log.TlsVersion = tls.VersionName(hello.maxVersion())
+		ciphers := withoutGrease(hello.Ciphers)
+		names := make([]string, len(ciphers))
+		for i, id := range ciphers {
+			names[i] = tls.CipherSuiteName(id)
+		}
+		log.TlsCiphers = strings.Join(names, ",")
+		log.Ja3 = hello.JA3Hash()
+		log.Ja4 = hello.JA4()
+	}
+	if state != nil {
+		log.TlsVersion = tls.VersionName(state.Version)
+	}
+}
+
+// requestTLSInfo 请求来自 HTTPS 监听时填充 TLS 相关的字段
+func requestTLSInfo(log *db.HttpRequestLog, r *http.Request) {
+	if r.TLS == nil {
+		return
+	}
+	var hello *clientHello
+	if hc, ok := r.Context().Value(helloContextKey{}).(*helloConn); ok {
+		hello, _ = hc.clientHello()
+	}
+	applyTLSInfo(log, hello, r.TLS)
+}
+
+// logHandshakeFailure 握手失败的连接只记录来源和指纹. 带 SNI 时只记录 listen_domain 中的域名
+func logHandshakeFailure(c *helloConn) {
+	hello, err := c.clientHello()
+	record := db.HttpRequestLog{
+		Timestamp:  c.accepted,
+		RemoteAddr: c.RemoteAddr().String(),
+		TlsError:   "handshake failed",
+	}
+	if err != nil {
+		record.TlsError = err.Error()
+	}
+	if hello != nil && hello.ServerName != "" {
+		zone, ok := isAllowedDomain(hello.ServerName)
+		if !ok {
+			return
+		}
+		record.Hostname, record.Zone = hello.ServerName, zone
+	}
+	applyTLSInfo(&record, hello, nil)
+	source, _, _ := net.SplitHostPort(record.RemoteAddr)
+	noise := db.MatchHttpNoise(source, "", "", "")
+	record.Noise = noise == db.NoiseStore
+	if noise == db.NoiseIgnore {
+		return
+	}
+	if err := db.GetDB().InsertLog(record); err != nil {
+		logrus.Errorf("Failed to insert log into database: %v", err)
+	}
+}
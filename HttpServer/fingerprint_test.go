@@ -0,0 +1,181 @@
+package HttpServer
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// testExt ClientHello 中的一个扩展
+type testExt struct {
+	typ  uint16
+	data []byte
+}
+
+func putUint16s(values ...uint16) []byte {
+	b := make([]byte, 2*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint16(b[2*i:], v)
+	}
+	return b
+}
+
+// vec16 加上两字节的长度前缀
+func vec16(b []byte) []byte {
+	return append(putUint16s(uint16(len(b))), b...)
+}
+
+func vec8(b []byte) []byte {
+	return append([]byte{byte(len(b))}, b...)
+}
+
+func sniExt(name string) testExt {
+	entry := append([]byte{0}, vec16([]byte(name))...)
+	return testExt{extServerName, vec16(entry)}
+}
+
+func alpnExt(protos ...string) testExt {
+	var list []byte
+	for _, p := range protos {
+		list = append(list, vec8([]byte(p))...)
+	}
+	return testExt{extALPN, vec16(list)}
+}
+
+// buildHello 构造 ClientHello 的 TLS 记录, exts 为 nil 时不带扩展块, recordSize 大于 0 时拆成多个记录
+func buildHello(version uint16, ciphers []uint16, exts []testExt, recordSize int) []byte {
+	body := putUint16s(version)
+	body = append(body, make([]byte, 32)...)
+	body = append(body, 0)
+	body = append(body, vec16(putUint16s(ciphers...))...)
+	body = append(body, 1, 0)
+	if exts != nil {
+		var block []byte
+		for _, ext := range exts {
+			block = append(block, putUint16s(ext.typ)...)
+			block = append(block, vec16(ext.data)...)
+		}
+		body = append(body, vec16(block)...)
+	}
+	msg := append([]byte{handshakeTypeClientHello, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...)
+	if recordSize <= 0 {
+		recordSize = len(msg)
+	}
+	var data []byte
+	for len(msg) > 0 {
+		n := recordSize
+		if n > len(msg) {
+			n = len(msg)
+		}
+		data = append(data, recordTypeHandshake, 3, 1)
+		data = append(data, vec16(msg[:n])...)
+		msg = msg[n:]
+	}
+	return data
+}
+
+func TestFingerprints(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		ja3     string
+		ja3Hash string
+		ja4     string
+	}{
+		{
+			// JA3 README 中的示例
+			name: "ja3 reference",
+			data: buildHello(0x0301,
+				[]uint16{47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4},
+				[]testExt{
+					sniExt("example.com"),
+					{extSupportedGroups, vec16(putUint16s(23, 24, 25))},
+					{extPointFormats, vec8([]byte{0})},
+				}, 0),
+			ja3:     "769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0",
+			ja3Hash: "ada70206e40642a3e4461f35503241d5",
+		},
+		{
+			// JA4 README 中的 Chrome 示例, 带 GREASE, 并拆成多个 TLS 记录
+			name: "ja4 chrome",
+			data: buildHello(0x0303,
+				[]uint16{0x2a2a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035},
+				[]testExt{
+					{0x3a3a, nil},
+					sniExt("example.com"),
+					{0x0017, nil},
+					{0xff01, []byte{0}},
+					{extSupportedGroups, vec16(putUint16s(0x4a4a, 0x001d, 0x0017, 0x0018))},
+					{extPointFormats, vec8([]byte{0})},
+					{0x0023, nil},
+					alpnExt("h2", "http/1.1"),
+					{0x0005, []byte{1, 0, 0, 0, 0}},
+					{extSignatureAlgs, vec16(putUint16s(0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601))},
+					{0x0012, nil},
+					{0x0033, vec16(nil)},
+					{0x002d, vec8([]byte{1})},
+					{extSupportedVersions, vec8(putUint16s(0x6a6a, 0x0304, 0x0303))},
+					{0x001b, []byte{2, 0, 2}},
+					{0x4469, nil},
+					{0x0015, make([]byte, 16)},
+				}, 100),
+			ja4: "t13d1516h2_8daaf6152771_e5627efa2ab1",
+		},
+		{
+			name:    "no extensions",
+			data:    buildHello(0x0301, []uint16{0x002f, 0x0035}, nil, 0),
+			ja3:     "769,47-53,,,",
+			ja3Hash: "dac4920d4335e769327dbf4e1b759e15",
+			ja4:     "t10i020000_f54dd463d39b_000000000000",
+		},
+		{
+			// 没有 signature_algorithms 时 JA4_c 只有排序后的扩展
+			name: "no signature algorithms",
+			data: buildHello(0x0303, []uint16{0x002f, 0x0035},
+				[]testExt{sniExt("a.example.com"), {extSupportedGroups, vec16(putUint16s(0x0017))}}, 0),
+			ja4: "t12d0202" + "00_f54dd463d39b_" + ja4Hash("000a"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hello, err := parseClientHello(tt.data)
+			if err != nil {
+				t.Fatalf("parseClientHello: %v", err)
+			}
+			if tt.ja3 != "" && hello.JA3() != tt.ja3 {
+				t.Errorf("JA3 = %s, want %s", hello.JA3(), tt.ja3)
+			}
+			if tt.ja3Hash != "" && hello.JA3Hash() != tt.ja3Hash {
+				t.Errorf("JA3Hash = %s, want %s", hello.JA3Hash(), tt.ja3Hash)
+			}
+			if tt.ja4 != "" && hello.JA4() != tt.ja4 {
+				t.Errorf("JA4 = %s, want %s", hello.JA4(), tt.ja4)
+			}
+		})
+	}
+}
+
+func TestParseClientHelloErrors(t *testing.T) {
+	full := buildHello(0x0303, []uint16{0x1301}, []testExt{sniExt("example.com")}, 0)
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"http", []byte("GET / HTTP/1.1\r\n"), errNotTLS},
+		{"short", full[:3], errIncompleteHello},
+		{"partial", full[:len(full)-4], errIncompleteHello},
+		{"truncated extension", func() []byte {
+			data := append([]byte(nil), full...)
+			// 扩展块的长度超过消息中剩余的数据
+			data[len(data)-len(sniExt("example.com").data)-6]++
+			return data
+		}(), errMalformedHello},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseClientHello(tt.data); err != tt.err {
+				t.Errorf("err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
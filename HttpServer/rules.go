@@ -0,0 +1,208 @@
+package HttpServer
+
+import (
+	"bflog/db"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// HTTP 响应规则的路径匹配方式
+const (
+	MatchExact  = "exact"
+	MatchPrefix = "prefix"
+	MatchGlob   = "glob"
+	MatchRegex  = "regex"
+)
+
+// MethodAny 匹配所有请求方法
+const MethodAny = "ANY"
+
+// httpRuleRefreshInterval 定时从数据库重新加载规则
+const httpRuleRefreshInterval = 10 * time.Second
+
+// httpRuleEntry 内存中的一条响应规则
+type httpRuleEntry struct {
+	rule      db.HttpResponse
+	matchType string
+	re        *regexp.Regexp
+	templates *ruleTemplates
+}
+
+// httpRuleTable 当前生效的 []*httpRuleEntry, 已按优先级排好序
+var httpRuleTable atomic.Value
+
+// hostOrder 相同 Priority 时按域名的具体程度排序: 精确域名和 token, 通配符, 不限域名
+func hostOrder(hostname string) int {
+	switch {
+	case hostname == "":
+		return 2
+	case strings.HasPrefix(hostname, "*."):
+		return 1
+	}
+	return 0
+}
+
+// matchTypeOrder 相同 Priority 时各匹配方式的先后顺序
+var matchTypeOrder = map[string]int{MatchExact: 0, MatchPrefix: 1, MatchGlob: 2, MatchRegex: 3}
+
+// NormalizeHttpRule 统一方法和匹配方式的大小写, 并校验路径模式和响应模板
+func NormalizeHttpRule(rule *db.HttpResponse) error {
+	if err := normalizeHttpPattern(rule); err != nil {
+		return err
+	}
+	return validateTemplates(rule)
+}
+
+// normalizeHttpPattern 统一方法, 匹配方式和域名的大小写, 并校验路径模式
+func normalizeHttpPattern(rule *db.HttpResponse) error {
+	rule.Hostname = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(rule.Hostname), "."))
+	if strings.Contains(strings.TrimPrefix(rule.Hostname, "*."), "*") || rule.Hostname == "*." {
+		return fmt.Errorf("通配符域名必须以 *. 开头: %s", rule.Hostname)
+	}
+	rule.Method = strings.ToUpper(strings.TrimSpace(rule.Method))
+	if rule.Method == "" {
+		rule.Method = MethodAny
+	}
+	rule.MatchType = strings.ToLower(strings.TrimSpace(rule.MatchType))
+	switch rule.MatchType {
+	case "", MatchExact, MatchPrefix:
+	case MatchGlob:
+		if _, err := path.Match(rule.Path, ""); err != nil {
+			return fmt.Errorf("通配符错误: %s", rule.Path)
+		}
+	case MatchRegex:
+		if _, err := regexp.Compile(rule.Path); err != nil {
+			return fmt.Errorf("正则表达式错误: %v", err)
+		}
+	default:
+		return fmt.Errorf("不支持的匹配方式: %s", rule.MatchType)
+	}
+	return nil
+}
+
+// ReloadHttpRules 从数据库重新加载全部响应规则
+func ReloadHttpRules() error {
+	rules, err := db.GetDB().GetAllHttpResponses()
+	if err != nil {
+		return err
+	}
+	httpRuleTable.Store(newHttpRuleEntries(rules))
+	return nil
+}
+
+// newHttpRuleEntries 把规则转换成排好序的规则表
+func newHttpRuleEntries(rules []db.HttpResponse) []*httpRuleEntry {
+	entries := make([]*httpRuleEntry, 0, len(rules))
+	for _, rule := range rules {
+		// 模板在这里解析一次, 模板错误在响应时返回 500, 这里只跳过路径模式错误的规则
+		if err := normalizeHttpPattern(&rule); err != nil {
+			logrus.Warnf("skip http rule %d: %v", rule.ID, err)
+			continue
+		}
+		entry := &httpRuleEntry{rule: rule, matchType: rule.MatchType, templates: newRuleTemplates(&rule)}
+		if entry.matchType == "" {
+			entry.matchType = MatchExact
+		}
+		if entry.matchType == MatchRegex {
+			entry.re = regexp.MustCompile(rule.Path)
+		}
+		entries = append(entries, entry)
+	}
+	sortHttpRules(entries)
+	return entries
+}
+
+// sortHttpRules 按 Priority, 域名, 匹配方式, 前缀长度和 ID 排序
+func sortHttpRules(entries []*httpRuleEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.rule.Priority != b.rule.Priority {
+			return a.rule.Priority < b.rule.Priority
+		}
+		if hostOrder(a.rule.Hostname) != hostOrder(b.rule.Hostname) {
+			return hostOrder(a.rule.Hostname) < hostOrder(b.rule.Hostname)
+		}
+		if hostOrder(a.rule.Hostname) == 1 && len(a.rule.Hostname) != len(b.rule.Hostname) {
+			return len(a.rule.Hostname) > len(b.rule.Hostname)
+		}
+		if matchTypeOrder[a.matchType] != matchTypeOrder[b.matchType] {
+			return matchTypeOrder[a.matchType] < matchTypeOrder[b.matchType]
+		}
+		if a.matchType == MatchPrefix && len(a.rule.Path) != len(b.rule.Path) {
+			return len(a.rule.Path) > len(b.rule.Path)
+		}
+		return a.rule.ID < b.rule.ID
+	})
+}
+
+// refreshHttpRules 周期性重新加载规则
+func refreshHttpRules() {
+	ticker := time.NewTicker(httpRuleRefreshInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := ReloadHttpRules(); err != nil {
+			logrus.Errorf("reload http rules: %v", err)
+		}
+	}
+}
+
+// matchHost 判断请求的域名是否匹配规则, zone 为请求命中的区域
+func (entry *httpRuleEntry) matchHost(hostname string, zone string) bool {
+	pattern := entry.rule.Hostname
+	switch {
+	case pattern == "":
+		return true
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(hostname, pattern[1:])
+	case !strings.Contains(pattern, "."):
+		return hostname == pattern+"."+zone
+	}
+	return hostname == pattern
+}
+
+// match 判断路径是否匹配, 返回 regex 规则命名分组捕获的路径参数
+func (entry *httpRuleEntry) match(urlPath string) (map[string]string, bool) {
+	switch entry.matchType {
+	case MatchPrefix:
+		return nil, strings.HasPrefix(urlPath, entry.rule.Path)
+	case MatchGlob:
+		ok, _ := path.Match(entry.rule.Path, urlPath)
+		return nil, ok
+	case MatchRegex:
+		m := entry.re.FindStringSubmatch(urlPath)
+		if m == nil {
+			return nil, false
+		}
+		params := make(map[string]string)
+		for i, name := range entry.re.SubexpNames() {
+			if name != "" {
+				params[name] = m[i]
+			}
+		}
+		return params, true
+	}
+	return nil, urlPath == entry.rule.Path
+}
+
+// matchHttpRule 返回第一条匹配域名, 请求方法和路径的规则以及路径参数, 没有时返回 nil
+func matchHttpRule(hostname string, zone string, method string, urlPath string) (*httpRuleEntry, map[string]string) {
+	entries, _ := httpRuleTable.Load().([]*httpRuleEntry)
+	for _, entry := range entries {
+		if entry.rule.Method != MethodAny && entry.rule.Method != method {
+			continue
+		}
+		if !entry.matchHost(hostname, zone) {
+			continue
+		}
+		if params, ok := entry.match(urlPath); ok {
+			return entry, params
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,134 @@
+package HttpServer
+
+import (
+	"bflog/db"
+	"testing"
+)
+
+// loadHttpRules 用给定的规则替换内存中的规则表
+func loadHttpRules(t *testing.T, rules []db.HttpResponse) {
+	t.Helper()
+	httpRuleTable.Store(newHttpRuleEntries(rules))
+	t.Cleanup(func() { httpRuleTable.Store([]*httpRuleEntry(nil)) })
+}
+
+func TestMatchHttpRuleOrder(t *testing.T) {
+	loadHttpRules(t, []db.HttpResponse{
+		// 兜底规则放到最后
+		{ID: 1, Path: "/.*", MatchType: MatchRegex, Priority: 1},
+		{ID: 2, Path: "/api/*", MatchType: MatchGlob},
+		{ID: 3, Path: "/api/", MatchType: MatchPrefix},
+		{ID: 4, Path: "/api/v1/", MatchType: MatchPrefix},
+		{ID: 5, Path: "/api/v1/users", MatchType: MatchExact},
+		{ID: 6, Path: "/api/v1/users", Method: "post"},
+		{ID: 7, Path: `/u/(?P<id>\d+)`, MatchType: MatchRegex},
+		// Priority 小的规则先于所有默认顺序
+		{ID: 8, Path: "/pinned", MatchType: MatchPrefix, Priority: -1},
+		{ID: 9, Path: "/pinned/exact"},
+		// 相同条件时 ID 小的优先
+		{ID: 11, Path: "/dup"},
+		{ID: 10, Path: "/dup"},
+	})
+	tests := []struct {
+		method, path string
+		want         int
+		params       map[string]string
+	}{
+		{"GET", "/api/v1/users", 5, nil},
+		{"POST", "/api/v1/users", 5, nil},
+		{"GET", "/api/v1/groups", 4, nil},
+		{"GET", "/api/v2", 3, nil},
+		{"GET", "/apix", 1, nil},
+		{"GET", "/u/42", 7, map[string]string{"id": "42"}},
+		{"GET", "/pinned/exact", 8, nil},
+		{"GET", "/dup", 10, nil},
+		{"GET", "nothing", 0, nil},
+	}
+	for _, tt := range tests {
+		entry, params := matchHttpRule("a.dnslog.test", "dnslog.test", tt.method, tt.path)
+		got := 0
+		if entry != nil {
+			got = entry.rule.ID
+		}
+		if got != tt.want {
+			t.Errorf("%s %s matched rule %d, want %d", tt.method, tt.path, got, tt.want)
+			continue
+		}
+		if len(params) != len(tt.params) || params["id"] != tt.params["id"] {
+			t.Errorf("%s %s params = %v, want %v", tt.method, tt.path, params, tt.params)
+		}
+	}
+}
+
+func TestMatchHttpRuleMethod(t *testing.T) {
+	loadHttpRules(t, []db.HttpResponse{
+		{ID: 1, Path: "/login", Method: "post"},
+		{ID: 2, Path: "/login", MatchType: MatchPrefix},
+	})
+	for method, want := range map[string]int{"POST": 1, "GET": 2} {
+		if entry, _ := matchHttpRule("a.dnslog.test", "dnslog.test", method, "/login"); entry == nil || entry.rule.ID != want {
+			t.Errorf("%s /login matched %v, want %d", method, entry, want)
+		}
+	}
+}
+
+func TestMatchHttpRuleHost(t *testing.T) {
+	loadHttpRules(t, []db.HttpResponse{
+		{ID: 1, Path: "/", Hostname: ""},
+		{ID: 2, Path: "/", Hostname: "*.dnslog.test"},
+		{ID: 3, Path: "/", Hostname: "*.sub.dnslog.test"},
+		{ID: 4, Path: "/", Hostname: "Exact.Dnslog.Test."},
+		{ID: 5, Path: "/", Hostname: "tok"},
+	})
+	tests := []struct {
+		hostname, zone string
+		want           int
+	}{
+		{"exact.dnslog.test", "dnslog.test", 4},
+		{"tok.dnslog.test", "dnslog.test", 5},
+		{"tok.other.test", "other.test", 5},
+		{"x.tok.dnslog.test", "dnslog.test", 2},
+		{"a.sub.dnslog.test", "dnslog.test", 3},
+		{"a.dnslog.test", "dnslog.test", 2},
+		{"dnslog.test", "dnslog.test", 1},
+		{"a.other.test", "other.test", 1},
+	}
+	for _, tt := range tests {
+		if entry, _ := matchHttpRule(tt.hostname, tt.zone, "GET", "/"); entry == nil || entry.rule.ID != tt.want {
+			t.Errorf("%s matched %v, want %d", tt.hostname, entry, tt.want)
+		}
+	}
+}
+
+func TestNormalizeHttpRule(t *testing.T) {
+	tests := []struct {
+		rule db.HttpResponse
+		ok   bool
+	}{
+		{db.HttpResponse{Path: "/a"}, true},
+		{db.HttpResponse{Path: "/a", MatchType: "GLOB"}, true},
+		{db.HttpResponse{Path: "/[", MatchType: MatchGlob}, false},
+		{db.HttpResponse{Path: "/(", MatchType: MatchRegex}, false},
+		{db.HttpResponse{Path: "/a", MatchType: "suffix"}, false},
+		{db.HttpResponse{Path: "/a", Hostname: "a.*.test"}, false},
+		{db.HttpResponse{Path: "/a", Hostname: "*."}, false},
+		{db.HttpResponse{Path: "/a", Body: "{{.Nope"}, false},
+	}
+	for _, tt := range tests {
+		rule := tt.rule
+		if err := NormalizeHttpRule(&rule); (err == nil) != tt.ok {
+			t.Errorf("NormalizeHttpRule(%+v) err = %v, want ok=%t", tt.rule, err, tt.ok)
+		}
+	}
+	rule := db.HttpResponse{Path: "/a", Method: " get ", MatchType: " Prefix", Hostname: "*.DNSLOG.test."}
+	if err := NormalizeHttpRule(&rule); err != nil {
+		t.Fatal(err)
+	}
+	if rule.Method != "GET" || rule.MatchType != MatchPrefix || rule.Hostname != "*.dnslog.test" {
+		t.Errorf("normalized = %q %q %q", rule.Method, rule.MatchType, rule.Hostname)
+	}
+	rule = db.HttpResponse{Path: "/a"}
+	if err := NormalizeHttpRule(&rule); err != nil || rule.Method != MethodAny {
+		t.Errorf("default method = %q, err %v", rule.Method, err)
+	}
+}
@@ -59,27 +59,40 @@ func parseJSONToHeaders(jsonStr string) (map[string][]string, error) {
 	return headers, nil
 }
 
-func isAllowedDomain(host string, allowedDomains []string) bool {
+// matchDomain 判断 hostname 是否匹配 listen_domain 中的一项, 以点开头的项匹配该域名及其所有子域名
+func matchDomain(hostname string, domain string) bool {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	if domain == "" {
+		return false
+	}
+	if strings.HasPrefix(domain, ".") {
+		return hostname == domain[1:] || strings.HasSuffix(hostname, domain)
+	}
+	return hostname == domain
+}
+
+// requestHostname 去掉 Host 中的端口和末尾的点并转为小写
+func requestHostname(host string) string {
 	hostname, _, err := net.SplitHostPort(host)
 	if err != nil {
 		// 如果没有端口信息，直接使用 host
 		hostname = host
 	}
-	for _, domain := range allowedDomains {
-		// 如果是通配符域名
-		if strings.HasPrefix(domain, ".") {
-			// 去掉通配符部分，只检查主域名是否匹配
-			if strings.HasSuffix(hostname, domain[1:]) {
-				return true
-			}
-		} else {
-			// 完全匹配检查
-			if hostname == domain {
-				return true
+	return strings.ToLower(strings.TrimSuffix(hostname, "."))
+}
+
+// isAllowedDomain 按 Host 找到对应的区域, 多个区域都匹配时取最长的那一项, 没有匹配时返回 false
+func isAllowedDomain(host string) (string, bool) {
+	hostname := requestHostname(host)
+	zone, longest := "", -1
+	for _, z := range config.GetZones() {
+		for _, domain := range strings.Split(z.ListenDomain, ",") {
+			if matchDomain(hostname, domain) && len(domain) > longest {
+				zone, longest = strings.ToLower(strings.TrimSuffix(z.Name, ".")), len(domain)
 			}
 		}
 	}
-	return false
+	return zone, longest >= 0
 }
 
 func httpStatusCode(code string) (int, error) {
@@ -90,18 +103,28 @@ func httpStatusCode(code string) (int, error) {
 	return statusCode, nil
 }
 
+// requestAddr 返回请求的客户端地址, 经过 Nginx 转发的 HTTP 请求使用 X-Real-Ip,
+// 地址为空或者为 "-" 时返回 false, 请求应当被拒绝
+func requestAddr(r *http.Request) (string, bool) {
+	remoteAddr := r.RemoteAddr
+	// HTTPS 监听直接面向客户端, 不经过 nginx
+	if config.GetBase().Nginx == 1 && r.TLS == nil {
+		remoteAddr = strings.TrimSpace(strings.Split(r.Header.Get("X-Real-Ip"), ",")[0])
+	}
+	return remoteAddr, remoteAddr != "" && remoteAddr != "-"
+}
+
 func logRequestHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	hostname := r.Host
-	allowedDomains := strings.Split(config.GetBase().Server.ListenDomain, ",")
-	if !isAllowedDomain(hostname, allowedDomains) {
+	zone, ok := isAllowedDomain(hostname)
+	if !ok {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
 	method := r.Method
 	url := r.URL.String()
 	path := r.URL.Path
-	remoteAddr := r.RemoteAddr
 	bodyBytes, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "Cannot read request body", http.StatusInternalServerError)
@@ -109,14 +132,8 @@ func logRequestHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	bodyString := string(bodyBytes)
 	headerJSON, _ := formatHeadersToJSON(r.Header)
-	if config.GetBase().Nginx == 1 {
-		remoteAddr = strings.Split(r.Header.Get("X-Real-Ip"), ",")[0]
-	}
-	if remoteAddr == "-" {
-		http.Error(w, "Cannot read request body", http.StatusInternalServerError)
-		return
-	}
-	if remoteAddr == "" {
+	remoteAddr, ok := requestAddr(r)
+	if !ok {
 		http.Error(w, "Cannot read request body", http.StatusInternalServerError)
 		return
 	}
@@ -129,9 +146,21 @@ func logRequestHandler(w http.ResponseWriter, r *http.Request) {
 		Header:     headerJSON,
 		Body:       bodyString,
 		Path:       path,
+		Zone:       zone,
+		RequestID:  newRequestID(),
 	}
-	if err := db.GetDB().InsertLog(httpRequestLog); err != nil {
-		logrus.Errorf("Failed to insert log into database: %v", err)
+	requestTLSInfo(&httpRequestLog, r)
+	source, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		source = strings.TrimSpace(remoteAddr)
+	}
+	// 命中噪音规则的请求照常响应, 按规则不记录或者记录到噪音中
+	noise := db.MatchHttpNoise(source, path, r.UserAgent(), method)
+	httpRequestLog.Noise = noise == db.NoiseStore
+	if noise != db.NoiseIgnore {
+		if err := db.GetDB().InsertLog(httpRequestLog); err != nil {
+			logrus.Errorf("Failed to insert log into database: %v", err)
+		}
 	}
 	decodedPath, err := base64.URLEncoding.DecodeString(path[1:]) // 去掉前导的 '/'
 	if err == nil {
@@ -159,37 +188,11 @@ func logRequestHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	}
-	//  todo 通配符path  参数解析
-	responseConfig, _ := db.GetDB().GetHttpResponse(path, method)
-	if responseConfig != nil {
-		// 设置响应头
-		responseHeaders, _ := parseJSONToHeaders(responseConfig.Header)
-		if responseHeaders != nil {
-			for key, values := range responseHeaders {
-				for _, value := range values {
-					w.Header().Add(key, value)
-				}
-			}
-		}
-		//w.Header().Set("Content-Type", "application/json")
-
-		// 如果存在重定向 URL
-		if responseConfig.RedirectUrl != "" {
-			http.Redirect(w, r, responseConfig.RedirectUrl, http.StatusFound)
-			return
-		}
-
-		// 设置状态码
-		//logrus.Info(responseConfig)
-		statusCode, err := strconv.Atoi(responseConfig.StatusCode)
-		if err != nil {
-			http.Error(w, "StatusCode must be a valid integer", http.StatusBadRequest)
-			return
-		}
-		w.WriteHeader(statusCode)
-
-		// 返回响应数据
-		_, _ = w.Write([]byte(responseConfig.Body))
+	entry, params := matchHttpRule(requestHostname(hostname), zone, method, path)
+	if entry != nil {
+		// 规则中的响应头, 重定向地址和响应体可以使用模板引用请求数据
+		data := newTemplateData(r, httpRequestLog.RequestID, remoteAddr, bodyBytes, params)
+		writeRuleResponse(w, r, entry, data)
 		return
 	} else {
 		// 默认响应
@@ -197,15 +200,55 @@ func logRequestHandler(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write([]byte("Request logged\n"))
 		return
 	}
+}
+
+// writeRuleResponse 按规则返回响应, 先渲染全部模板再写出响应头,
+// 渲染失败时返回 500, 规则中的响应头和半截的渲染结果都不会发给客户端
+func writeRuleResponse(w http.ResponseWriter, r *http.Request, entry *httpRuleEntry, data *templateData) {
+	resp, err := entry.templates.render(data)
+	if err != nil {
+		logrus.Warnf("render http rule %d: %v", entry.rule.ID, err)
+		http.Error(w, "template error", http.StatusInternalServerError)
+		return
+	}
+	// 设置响应头
+	for key, values := range resp.header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	//w.Header().Set("Content-Type", "application/json")
+
+	// 如果存在重定向 URL
+	if entry.rule.RedirectUrl != "" {
+		http.Redirect(w, r, resp.redirect, http.StatusFound)
+		return
+	}
 
-	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write([]byte("Request logged\n"))
-	// todo 默认返回值
-	return
+	// 设置状态码
+	statusCode, err := strconv.Atoi(entry.rule.StatusCode)
+	if err != nil {
+		http.Error(w, "StatusCode must be a valid integer", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(statusCode)
+
+	// 返回响应数据
+	_, _ = w.Write([]byte(resp.body))
 }
 
 func Start() error {
+	if err := ReloadHttpRules(); err != nil {
+		logrus.Errorf("load http rules: %v", err)
+	}
+	go refreshHttpRules()
 	http.HandleFunc("/", logRequestHandler)
+	if config.GetBase().Dns.Doh.Enabled {
+		http.HandleFunc(dohPath(), dohHandler)
+	}
+	if config.GetBase().Server.SSL.Enabled {
+		go startTLS(http.DefaultServeMux)
+	}
 	port := ":" + config.GetBase().Server.Port
 
 	err := http.ListenAndServe(port, nil)
@@ -0,0 +1,246 @@
+package HttpServer
+
+import (
+	"bflog/db"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+)
+
+// maxTemplateOutput 模板渲染结果的最大字节数, 避免反射过大的请求内容
+const maxTemplateOutput = 1 << 20
+
+var errTemplateOutput = errors.New("template output too large")
+
+// templateFuncs 模板中可以使用的额外函数, 内置的 html/js/urlquery 可以用来转义
+var templateFuncs = template.FuncMap{
+	"b64enc": func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+	"b64dec": func(s string) string {
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return ""
+		}
+		return string(b)
+	},
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// templateData 渲染响应规则时可以引用的请求数据, 例如 {{.RemoteIP}}, {{.Params.token}},
+// {{index .Header "User-Agent"}}, {{.Query.url}}, {{.Fields.name}}
+type templateData struct {
+	RequestID  string
+	RemoteAddr string
+	RemoteIP   string
+	Host       string
+	Method     string
+	Path       string
+	URL        string
+	// Params regex 规则命名分组捕获的路径参数
+	Params map[string]string
+	// Query 和 Header 每个名称只取第一个值
+	Query  map[string]string
+	Header map[string]string
+	Body   string
+	// Fields JSON 对象或表单请求体中的顶层字段, 非字符串的 JSON 值保留为 JSON 文本
+	Fields map[string]string
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func firstValues(values map[string][]string) map[string]string {
+	m := make(map[string]string, len(values))
+	for key, v := range values {
+		if len(v) > 0 {
+			m[key] = v[0]
+		}
+	}
+	return m
+}
+
+// bodyFields 按 Content-Type 解析 JSON 对象或表单请求体, 其他类型返回空 map
+func bodyFields(contentType string, body []byte) map[string]string {
+	fields := make(map[string]string)
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		var object map[string]json.RawMessage
+		if json.Unmarshal(body, &object) != nil {
+			break
+		}
+		for key, raw := range object {
+			// null 也能解析成空字符串, 只把 JSON 字符串当作字符串
+			var s string
+			if len(raw) > 0 && raw[0] == '"' && json.Unmarshal(raw, &s) == nil {
+				fields[key] = s
+			} else {
+				fields[key] = string(raw)
+			}
+		}
+	case mediaType == "application/x-www-form-urlencoded":
+		if values, err := url.ParseQuery(string(body)); err == nil {
+			fields = firstValues(values)
+		}
+	}
+	return fields
+}
+
+func newTemplateData(r *http.Request, requestID string, remoteAddr string, body []byte, params map[string]string) *templateData {
+	remoteIP, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		remoteIP = strings.TrimSpace(remoteAddr)
+	}
+	if params == nil {
+		params = make(map[string]string)
+	}
+	return &templateData{
+		RequestID:  requestID,
+		RemoteAddr: remoteAddr,
+		RemoteIP:   remoteIP,
+		Host:       r.Host,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		URL:        r.URL.String(),
+		Params:     params,
+		Query:      firstValues(r.URL.Query()),
+		Header:     firstValues(r.Header),
+		Body:       string(body),
+		Fields:     bodyFields(r.Header.Get("Content-Type"), body),
+	}
+}
+
+// limitedBuffer 超过上限后返回错误, 中止模板执行
+type limitedBuffer struct {
+	bytes.Buffer
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > maxTemplateOutput {
+		return 0, errTemplateOutput
+	}
+	return b.Buffer.Write(p)
+}
+
+// ruleTemplate 加载规则时解析好的一段模板, tmpl 为 nil 时原样输出 text, err 为解析错误
+type ruleTemplate struct {
+	text string
+	tmpl *template.Template
+	err  error
+}
+
+// parseRuleTemplate 解析规则中的一段文本, 不含 {{ 的内容不作为模板. 缺少的字段渲染为空字符串
+func parseRuleTemplate(text string) *ruleTemplate {
+	t := &ruleTemplate{text: text}
+	if strings.Contains(text, "{{") {
+		t.tmpl, t.err = template.New("").Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+	}
+	return t
+}
+
+// execute 渲染模板, 解析错误也在这里返回
+func (t *ruleTemplate) execute(data *templateData) (string, error) {
+	if t.err != nil {
+		return "", t.err
+	}
+	if t.tmpl == nil {
+		return t.text, nil
+	}
+	var buf limitedBuffer
+	if err := t.tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// executeHeader 渲染响应头的值, 去掉换行防止注入额外的响应头
+func (t *ruleTemplate) executeHeader(data *templateData) (string, error) {
+	value, err := t.execute(data)
+	if err != nil {
+		return "", err
+	}
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value), nil
+}
+
+// ruleTemplates 一条响应规则中的全部模板, 在加载规则时解析
+type ruleTemplates struct {
+	headers  map[string][]*ruleTemplate
+	redirect *ruleTemplate
+	body     *ruleTemplate
+}
+
+func newRuleTemplates(rule *db.HttpResponse) *ruleTemplates {
+	t := &ruleTemplates{
+		headers:  make(map[string][]*ruleTemplate),
+		redirect: parseRuleTemplate(rule.RedirectUrl),
+		body:     parseRuleTemplate(rule.Body),
+	}
+	headers, _ := parseJSONToHeaders(rule.Header)
+	for key, values := range headers {
+		for _, value := range values {
+			t.headers[key] = append(t.headers[key], parseRuleTemplate(value))
+		}
+	}
+	return t
+}
+
+// renderedResponse 渲染好的响应头, 重定向地址和响应体
+type renderedResponse struct {
+	header   http.Header
+	redirect string
+	body     string
+}
+
+// render 渲染全部模板, 任何一个失败都返回错误, 这时还没有写出规则中的任何响应头.
+// 有重定向地址时不渲染响应体
+func (t *ruleTemplates) render(data *templateData) (*renderedResponse, error) {
+	resp := &renderedResponse{header: make(http.Header)}
+	for key, values := range t.headers {
+		for _, value := range values {
+			rendered, err := value.executeHeader(data)
+			if err != nil {
+				return nil, err
+			}
+			resp.header.Add(key, rendered)
+		}
+	}
+	var err error
+	if t.redirect.text != "" {
+		resp.redirect, err = t.redirect.executeHeader(data)
+	} else {
+		resp.body, err = t.body.execute(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// validateTemplates 检查规则中的模板语法, 响应头在 JSON 解析之后逐个检查
+func validateTemplates(rule *db.HttpResponse) error {
+	texts := []string{rule.Body, rule.RedirectUrl}
+	if headers, err := parseJSONToHeaders(rule.Header); err == nil {
+		for _, values := range headers {
+			texts = append(texts, values...)
+		}
+	}
+	for _, text := range texts {
+		if err := parseRuleTemplate(text).err; err != nil {
+			return fmt.Errorf("模板错误: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package HttpServer
+
+import (
+	"bflog/db"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTemplateRender(t *testing.T) {
+	r := httptest.NewRequest("POST", "http://tok.dnslog.test/u/42?url=http%3A%2F%2Fa&url=b", nil)
+	r.Header.Set("User-Agent", "curl/8.0")
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	body := []byte(`{"name":"bob","age":3,"tags":["a"]}`)
+	data := newTemplateData(r, "abc123", "192.0.2.1:5555", body, map[string]string{"id": "42"})
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"plain {text}", "plain {text}"},
+		{"{{.RequestID}} {{.RemoteIP}} {{.RemoteAddr}}", "abc123 192.0.2.1 192.0.2.1:5555"},
+		{"{{.Method}} {{.Host}} {{.Path}}", "POST tok.dnslog.test /u/42"},
+		{"{{.Params.id}}", "42"},
+		// Query 和 Header 只取第一个值
+		{"{{.Query.url}}", "http://a"},
+		{`{{index .Header "User-Agent"}}`, "curl/8.0"},
+		{"{{.Fields.name}} {{.Fields.age}} {{.Fields.tags}}", `bob 3 ["a"]`},
+		// 缺少的字段渲染为空字符串
+		{"[{{.Params.missing}}]", "[]"},
+		{"{{b64enc .Fields.name}} {{b64dec \"Ym9i\"}} {{b64dec \"!!\"}}", "Ym9i bob "},
+		{"{{upper .Fields.name}} {{lower .Method}}", "BOB post"},
+		{"{{html \"<b>\"}} {{urlquery \"a b\"}}", "&lt;b&gt; a+b"},
+	}
+	for _, tt := range tests {
+		got, err := parseRuleTemplate(tt.text).execute(data)
+		if err != nil {
+			t.Errorf("execute(%q): %v", tt.text, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("execute(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+
+	if got, err := parseRuleTemplate("a{{\"\\r\\nX-Injected: 1\"}}").executeHeader(data); err != nil || got != "aX-Injected: 1" {
+		t.Errorf("executeHeader = %q, %v", got, err)
+	}
+	if _, err := parseRuleTemplate("{{.Nope").execute(data); err == nil {
+		t.Error("execute with syntax error succeeded")
+	}
+	// 超过输出上限时返回错误
+	data.Body = strings.Repeat("x", maxTemplateOutput/2+1)
+	if _, err := parseRuleTemplate("{{.Body}}{{.Body}}").execute(data); err == nil {
+		t.Error("execute over the output limit succeeded")
+	}
+}
+
+func TestBodyFields(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+		want        map[string]string
+	}{
+		{"application/x-www-form-urlencoded", "a=1&a=2&b=x+y", map[string]string{"a": "1", "b": "x y"}},
+		{"application/vnd.api+json", `{"a": "1", "b": null}`, map[string]string{"a": "1", "b": "null"}},
+		{"application/json", `["not","object"]`, map[string]string{}},
+		{"text/plain", "a=1", map[string]string{}},
+	}
+	for _, tt := range tests {
+		got := bodyFields(tt.contentType, []byte(tt.body))
+		if len(got) != len(tt.want) {
+			t.Errorf("bodyFields(%s) = %v, want %v", tt.contentType, got, tt.want)
+			continue
+		}
+		for key, value := range tt.want {
+			if got[key] != value {
+				t.Errorf("bodyFields(%s)[%s] = %q, want %q", tt.contentType, key, got[key], value)
+			}
+		}
+	}
+}
+
+func TestValidateTemplates(t *testing.T) {
+	tests := []struct {
+		rule db.HttpResponse
+		ok   bool
+	}{
+		{db.HttpResponse{Body: "{{.RemoteIP}}", RedirectUrl: "https://x/{{.Params.id}}"}, true},
+		{db.HttpResponse{Body: "{{.RemoteIP"}, false},
+		{db.HttpResponse{RedirectUrl: "{{nosuchfunc .Path}}"}, false},
+		{db.HttpResponse{Header: `{"X-Id": "{{.RequestID}}"}`}, true},
+		{db.HttpResponse{Header: `{"X-Id": "{{.RequestID"}`}, false},
+	}
+	for _, tt := range tests {
+		rule := tt.rule
+		if err := validateTemplates(&rule); (err == nil) != tt.ok {
+			t.Errorf("validateTemplates(%+v) err = %v, want ok=%t", tt.rule, err, tt.ok)
+		}
+	}
+}
+
+func TestWriteRuleResponse(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://tok.dnslog.test/x", nil)
+	headers := `{"Set-Cookie": "session=1", "X-Id": "{{.RequestID}}"}`
+	tests := []struct {
+		name   string
+		rule   db.HttpResponse
+		body   string
+		status int
+		want   string
+		header map[string]string
+	}{
+		{"rendered", db.HttpResponse{StatusCode: "201", Header: headers, Body: "hi {{.RemoteIP}}"}, "", 201, "hi 192.0.2.1",
+			map[string]string{"Set-Cookie": "session=1", "X-Id": "abc123"}},
+		{"redirect", db.HttpResponse{StatusCode: "200", Header: headers, RedirectUrl: "https://x/{{.RequestID}}", Body: "{{.Nope"}, "", 302, "",
+			map[string]string{"Set-Cookie": "session=1", "Location": "https://x/abc123"}},
+		// 模板错误时不发出规则中的响应头
+		{"syntax error", db.HttpResponse{StatusCode: "200", Header: headers, Body: "{{.Nope"}, "", 500, "template error\n",
+			map[string]string{"Set-Cookie": "", "X-Id": ""}},
+		{"output limit", db.HttpResponse{StatusCode: "200", Header: headers, Body: "{{.Body}}{{.Body}}"}, strings.Repeat("x", maxTemplateOutput/2+1), 500, "template error\n",
+			map[string]string{"Set-Cookie": "", "X-Id": ""}},
+		{"redirect error", db.HttpResponse{StatusCode: "200", Header: headers, RedirectUrl: "{{.Nope"}, "", 500, "template error\n",
+			map[string]string{"Set-Cookie": "", "Location": ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries := newHttpRuleEntries([]db.HttpResponse{tt.rule})
+			if len(entries) != 1 {
+				t.Fatalf("rule skipped")
+			}
+			data := newTemplateData(r, "abc123", "192.0.2.1:5555", []byte(tt.body), nil)
+			w := httptest.NewRecorder()
+			writeRuleResponse(w, r, entries[0], data)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.want != "" && w.Body.String() != tt.want {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.want)
+			}
+			for key, want := range tt.header {
+				if got := w.Header().Get(key); got != want {
+					t.Errorf("header %s = %q, want %q", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRuleTemplatesParsedOnLoad(t *testing.T) {
+	entries := newHttpRuleEntries([]db.HttpResponse{
+		{ID: 1, Path: "/a", Body: "{{.Path}}", Header: `{"X-A": ["{{.Method}}", "b"]}`},
+		{ID: 2, Path: "/b", Body: "plain"},
+	})
+	tmpl := entries[0].templates
+	if tmpl.body.tmpl == nil || len(tmpl.headers["X-A"]) != 2 || tmpl.headers["X-A"][0].tmpl == nil || tmpl.headers["X-A"][1].tmpl != nil {
+		t.Errorf("rule 1 templates not parsed: %+v", tmpl)
+	}
+	if entries[1].templates.body.tmpl != nil {
+		t.Error("plain body parsed as a template")
+	}
+}
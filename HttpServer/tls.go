@@ -0,0 +1,276 @@
+package HttpServer
+
+import (
+	"bflog/config"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// certWatchInterval 检查证书文件是否修改的间隔
+	certWatchInterval = 10 * time.Second
+	// selfSignedValidity 自签名证书的有效期, 剩余不足 selfSignedRenew 时重新生成
+	selfSignedValidity = 365 * 24 * time.Hour
+	selfSignedRenew    = 30 * 24 * time.Hour
+	// selfSignedCheckInterval 检查自签名证书是否需要重新生成的间隔
+	selfSignedCheckInterval = time.Hour
+	defaultHttpsPort        = "443"
+	defaultCertCache        = "certs"
+)
+
+// certStore 当前使用的证书, 握手时通过 GetCertificate 读取, 重新加载时整体替换
+type certStore struct {
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+func (s *certStore) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.cert == nil {
+		return nil, errors.New("no certificate loaded")
+	}
+	return s.cert, nil
+}
+
+func (s *certStore) set(cert *tls.Certificate) {
+	s.mu.Lock()
+	s.cert = cert
+	s.mu.Unlock()
+}
+
+// loadFiles 证书或私钥文件的修改时间变化时重新加载, 返回是否加载了新证书
+func (s *certStore) loadFiles(certFile string, keyFile string) (bool, error) {
+	certInfo, err := os.Stat(certFile)
+	if err != nil {
+		return false, err
+	}
+	keyInfo, err := os.Stat(keyFile)
+	if err != nil {
+		return false, err
+	}
+	s.mu.RLock()
+	unchanged := s.cert != nil && certInfo.ModTime().Equal(s.certMod) && keyInfo.ModTime().Equal(s.keyMod)
+	s.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	s.cert, s.certMod, s.keyMod = &cert, certInfo.ModTime(), keyInfo.ModTime()
+	s.mu.Unlock()
+	return true, nil
+}
+
+// watchFiles 周期性检查证书文件, 加载失败时继续使用旧证书
+func (s *certStore) watchFiles(certFile string, keyFile string) {
+	ticker := time.NewTicker(certWatchInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if loaded, err := s.loadFiles(certFile, keyFile); err != nil {
+			logrus.Errorf("reload certificate: %v", err)
+		} else if loaded {
+			logrus.Infof("reloaded certificate %s", certFile)
+		}
+	}
+}
+
+// watchSelfSigned 周期性检查自签名证书, 快过期或 listen_domain 变化时重新生成
+func (s *certStore) watchSelfSigned(cacheDir string) {
+	ticker := time.NewTicker(selfSignedCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mu.RLock()
+		cert := s.cert
+		s.mu.RUnlock()
+		if cert != nil && usableCert(cert, certDomains(), time.Now()) {
+			continue
+		}
+		cert, err := selfSignedCert(cacheDir)
+		if err != nil {
+			logrus.Errorf("renew self-signed certificate: %v", err)
+			continue
+		}
+		s.set(cert)
+	}
+}
+
+// certDomains 返回自签名证书包含的域名, 以点开头的 listen_domain 同时包含该域名和 *.域名
+func certDomains() []string {
+	seen := make(map[string]bool)
+	var names []string
+	add := func(name string) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, z := range config.GetZones() {
+		for _, domain := range strings.Split(z.ListenDomain, ",") {
+			domain = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+			if strings.HasPrefix(domain, ".") {
+				add(domain[1:])
+				add("*" + domain)
+			} else {
+				add(domain)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// generateSelfSigned 生成 ECDSA P-256 自签名证书, 返回 PEM 格式的证书和私钥
+func generateSelfSigned(names []string, now time.Time) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: names[0]},
+		DNSNames:              names,
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return certPEM, keyPEM, nil
+}
+
+// usableCert 缓存的证书包含全部域名并且没有快过期时可以继续使用
+func usableCert(cert *tls.Certificate, names []string, now time.Time) bool {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil || now.Add(selfSignedRenew).After(leaf.NotAfter) {
+		return false
+	}
+	have := append([]string(nil), leaf.DNSNames...)
+	sort.Strings(have)
+	return strings.Join(have, ",") == strings.Join(names, ",")
+}
+
+// selfSignedCert 读取 cache_dir 中缓存的自签名证书, 域名变化或快过期时重新生成并写回缓存
+func selfSignedCert(cacheDir string) (*tls.Certificate, error) {
+	names := certDomains()
+	if len(names) == 0 {
+		return nil, errors.New("no listen_domain for self-signed certificate")
+	}
+	certFile := filepath.Join(cacheDir, "selfsigned.crt")
+	keyFile := filepath.Join(cacheDir, "selfsigned.key")
+	now := time.Now()
+	if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil && usableCert(&cert, names, now) {
+		return &cert, nil
+	}
+	certPEM, keyPEM, err := generateSelfSigned(names, now)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		return nil, err
+	}
+	logrus.Infof("generated self-signed certificate for %s", strings.Join(names, ","))
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// newTLSServer 按配置加载证书并创建 HTTPS 服务器
+func newTLSServer(handler http.Handler) (*http.Server, error) {
+	cfg := config.GetBase().Server.SSL
+	store := &certStore{}
+	if cfg.SelfSigned {
+		cacheDir := cfg.CacheDir
+		if cacheDir == "" {
+			cacheDir = defaultCertCache
+		}
+		cert, err := selfSignedCert(cacheDir)
+		if err != nil {
+			return nil, err
+		}
+		store.set(cert)
+		go store.watchSelfSigned(cacheDir)
+	} else {
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return nil, fmt.Errorf("ssl 需要配置 cert_file 和 key_file, 或者开启 self_signed")
+		}
+		if _, err := store.loadFiles(cfg.CertFile, cfg.KeyFile); err != nil {
+			return nil, err
+		}
+		go store.watchFiles(cfg.CertFile, cfg.KeyFile)
+	}
+	port := cfg.Port
+	if port == "" {
+		port = defaultHttpsPort
+	}
+	return &http.Server{
+		Addr:        ":" + port,
+		Handler:     handler,
+		ConnContext: helloConnContext,
+		TLSConfig: &tls.Config{
+			GetCertificate: store.getCertificate,
+			// 回连的客户端可能是很旧的 Java/.NET, 尽量完成握手以便记录请求
+			MinVersion: tls.VersionTLS10,
+		},
+	}, nil
+}
+
+// startTLS 启动 HTTPS 监听, 请求与 HTTP 使用相同的处理逻辑
+func startTLS(handler http.Handler) {
+	server, err := newTLSServer(handler)
+	if err != nil {
+		logrus.Fatalf("Error loading certificate: %v\n", err)
+	}
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		logrus.Fatalf("Error starting https server: %v\n", err)
+	}
+	logrus.Infof("start https server on %s", server.Addr)
+	if err := server.ServeTLS(&helloListener{Listener: ln}, "", ""); err != nil {
+		logrus.Fatalf("Error starting https server: %v\n", err)
+	}
+}
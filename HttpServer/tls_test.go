@@ -0,0 +1,39 @@
+package HttpServer
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+)
+
+func TestUsableCert(t *testing.T) {
+	names := []string{"*.dnslog.test", "dnslog.test"}
+	now := time.Now()
+	certPEM, keyPEM, err := generateSelfSigned(names, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		names []string
+		now   time.Time
+		want  bool
+	}{
+		{"fresh", names, now, true},
+		{"renew window", names, now.Add(selfSignedValidity - selfSignedRenew + time.Hour), false},
+		{"expired", names, now.Add(selfSignedValidity + time.Hour), false},
+		{"domain added", append([]string{"*.other.test"}, names...), now, false},
+		{"domain removed", names[:1], now, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := usableCert(&cert, tt.names, tt.now); got != tt.want {
+				t.Errorf("usableCert = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,14 +1,19 @@
 package config
 
 import (
+	"bflog/utils"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"os"
+	"strings"
 )
 
 var baseConfig *Config
 
+// zoneList 加载配置时补全好的区域列表, 查询时直接使用, 不再每次重新生成
+var zoneList []ZoneConfig
+
 type Config struct {
 	Nginx     int    `json:"nginx"`
 	Redispass string `mapstructure:"redispass"`
@@ -24,24 +29,251 @@ type Config struct {
 	Server struct {
 		ListenDomain string `mapstructure:"listen_domain"`
 		Defaultip    string `mapstructure:"default_ip"`
+		Defaultipv6  string `mapstructure:"default_ipv6"`
 		Subdomain    string `mapstructure:"subdomain"`
 		Port         string `mapstructure:"http_port"`
 		Admindomain  string `mapstructure:"admin_domain"`
 		Adminport    string `mapstructure:"admin_port"`
 		Seckey       string `mapstructure:"seckey"`
-		SSL          struct {
-			Enabled  bool `mapstructure:"enabled"`
-			CertFile bool `mapstructure:"cert_file"`
-			KeyFile  bool `mapstructure:"key_file"`
-		} `mapstructure:"ssl""`
+		// SSL HTTPS 监听, 证书文件修改后自动重新加载; self_signed 时为 listen_domain 生成并缓存自签名的通配符证书
+		SSL struct {
+			Enabled    bool   `mapstructure:"enabled"`
+			Port       string `mapstructure:"port"`
+			CertFile   string `mapstructure:"cert_file"`
+			KeyFile    string `mapstructure:"key_file"`
+			SelfSigned bool   `mapstructure:"self_signed"`
+			CacheDir   string `mapstructure:"cache_dir"`
+		} `mapstructure:"ssl"`
 	} `mapstructure:"server"`
-	Sqldebug int `mapstructure:"sqldebug"`
+	Sqldebug int       `mapstructure:"sqldebug"`
+	Dns      DnsConfig `mapstructure:"dns"`
+}
+
+// DnsConfig DNS 服务器的权威区域配置
+type DnsConfig struct {
+	Listen struct {
+		Udp []string `mapstructure:"udp"`
+		Tcp []string `mapstructure:"tcp"`
+	} `mapstructure:"listen"`
+	// Dot DNS over TLS 监听, Listen 为空时不启用
+	Dot struct {
+		Listen   []string `mapstructure:"listen"`
+		CertFile string   `mapstructure:"cert_file"`
+		KeyFile  string   `mapstructure:"key_file"`
+	} `mapstructure:"dot"`
+	// Doh 在 HTTP 服务器上提供 RFC 8484 DNS over HTTPS 接口
+	Doh struct {
+		Enabled bool   `mapstructure:"enabled"`
+		Path    string `mapstructure:"path"`
+	} `mapstructure:"doh"`
+	// Workers/Queue 为处理查询的协程数和等待队列长度, 队列满时直接丢弃查询
+	Workers int `mapstructure:"workers"`
+	Queue   int `mapstructure:"queue"`
+	// Persist dnslog 写库队列, 写库慢时不阻塞应答
+	Persist struct {
+		Queue int `mapstructure:"queue"`
+		// Policy 为队列满时的处理方式: drop 丢弃, sample 队列接近满时按 SampleRate 采样, spool 写入 SpoolFile 稍后补录
+		Policy     string `mapstructure:"policy"`
+		SampleRate int    `mapstructure:"sample_rate"`
+		SpoolFile  string `mapstructure:"spool_file"`
+	} `mapstructure:"persist"`
+	Rrl RrlConfig `mapstructure:"rrl"`
+	// Dnssec 在线签名, KeyDir 中没有密钥时自动生成
+	Dnssec struct {
+		Enabled bool   `mapstructure:"enabled"`
+		KeyDir  string `mapstructure:"key_dir"`
+	} `mapstructure:"dnssec"`
+	// Acme 在管理端口提供 acme-dns 兼容的 /register 和 /update 接口
+	Acme struct {
+		Enabled bool `mapstructure:"enabled"`
+		// OpenRegister 为 false 时 /register 需要管理后台的 Auth-Token
+		OpenRegister bool   `mapstructure:"open_register"`
+		Ttl          uint32 `mapstructure:"ttl"`
+	} `mapstructure:"acme"`
+	// DefaultTtl 区域没有配置 ttl 时的默认 TTL, 为空时为 60
+	DefaultTtl *uint32 `mapstructure:"default_ttl"`
+	// Zones 权威区域列表, 为空时使用 server.subdomain 以及下面的 soa/ns 作为唯一的区域
+	Zones   []ZoneConfig  `mapstructure:"zones"`
+	Forward ForwardConfig `mapstructure:"forward"`
+	// ResolverFile 公共解析器网段数据文件, 默认 resolvers.txt
+	ResolverFile string `mapstructure:"resolver_file"`
+	// OutOfZone 区域外查询的响应码, refused 或 nxdomain
+	OutOfZone string      `mapstructure:"out_of_zone"`
+	Soa       SoaConfig   `mapstructure:"soa"`
+	Ns        []NsConfig  `mapstructure:"ns"`
+	Exfil     ExfilConfig `mapstructure:"exfil"`
+}
+
+// RrlConfig UDP 应答限速, 各项速率为 0 时不限制
+type RrlConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// 每个来源网段对同一查询名每秒的应答数, 以及错误应答数
+	ResponsesPerSecond int `mapstructure:"responses_per_second"`
+	ErrorsPerSecond    int `mapstructure:"errors_per_second"`
+	// 所有来源对同一查询名每秒的应答数
+	QnamePerSecond int `mapstructure:"qname_per_second"`
+	// 每个来源网段每秒的应答字节数
+	BytesPerSecond int `mapstructure:"bytes_per_second"`
+	Window         int `mapstructure:"window"`
+	// Slip 每 Slip 个被限速的应答返回一个 TC=1 的空应答, 0 表示全部丢弃
+	Slip       int `mapstructure:"slip"`
+	Ipv4Prefix int `mapstructure:"ipv4_prefix"`
+	Ipv6Prefix int `mapstructure:"ipv6_prefix"`
+	// LogSample 被限速的查询每 LogSample 条记录一条
+	LogSample int `mapstructure:"log_sample"`
+	// MaxBuckets 计数桶数量的上限, 超过时淘汰最久没有使用的桶, 0 表示默认值 100000
+	MaxBuckets int `mapstructure:"max_buckets"`
+}
+
+// ForwardConfig 把不属于任何区域的查询转发到上游解析器并缓存结果, 让 bflog 作为实验环境中记录日志的递归解析器.
+// 开启后服务器就是一个开放解析器, 应当用 AllowFrom 限制来源
+type ForwardConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Upstreams 上游地址, 例如 8.8.8.8:53, 省略端口时为 53, 按顺序尝试
+	Upstreams []string `mapstructure:"upstreams"`
+	// Timeout 每个上游的超时时间, 毫秒
+	Timeout int `mapstructure:"timeout"`
+	// CacheSize 缓存的应答数, 0 表示默认值, 负数表示不缓存
+	CacheSize int `mapstructure:"cache_size"`
+	// AllowFrom 允许使用转发的来源网段或单个地址, 为空时不限制, 格式错误时加载配置失败
+	AllowFrom []string `mapstructure:"allow_from"`
+	// Concurrency 同时等待上游应答的查询数上限, 超过时丢弃查询, 0 表示默认值 256
+	Concurrency int `mapstructure:"concurrency"`
+}
+
+// ExfilConfig 通过 DNS label 外带数据的识别方案
+type ExfilConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Scheme 描述区域名之前的各个 label, 可用 <seq> <chunk> <token> <total>, 其他内容按原样匹配
+	Scheme string `mapstructure:"scheme"`
+	// Encoding 为 chunk 的编码, hex/base32/base64url;
+	// base64url 区分大小写, 只适用于不做 0x20 大小写随机化的解析器
+	Encoding string `mapstructure:"encoding"`
+	SeqStart int    `mapstructure:"seq_start"`
+}
+
+type SoaConfig struct {
+	Mname   string `mapstructure:"mname"`
+	Rname   string `mapstructure:"rname"`
+	Serial  uint32 `mapstructure:"serial"`
+	Refresh uint32 `mapstructure:"refresh"`
+	Retry   uint32 `mapstructure:"retry"`
+	Expire  uint32 `mapstructure:"expire"`
+	// Minttl 否定缓存时间, 为空时使用 60, 可以设置为 0 关闭否定缓存
+	Minttl *uint32 `mapstructure:"minttl"`
+	Ttl    uint32  `mapstructure:"ttl"`
+}
+
+// ZoneConfig 一个回连域名的权威区域, 留空的字段使用全局配置
+type ZoneConfig struct {
+	Name        string `mapstructure:"name"`
+	DefaultIp   string `mapstructure:"default_ip"`
+	DefaultIpv6 string `mapstructure:"default_ipv6"`
+	// Ttl 未命中规则的名称以及没有设置 TTL 的规则的应答 TTL, 为空时使用 dns.default_ttl
+	Ttl *uint32    `mapstructure:"ttl"`
+	Soa SoaConfig  `mapstructure:"soa"`
+	Ns  []NsConfig `mapstructure:"ns"`
+	// ListenDomain HTTP 服务器对该区域接受的 Host, 逗号分隔, 以点开头表示所有子域名, 留空时为 .<name>
+	ListenDomain string `mapstructure:"listen_domain"`
+}
+
+// NsConfig NS 记录以及对应的 glue 地址
+type NsConfig struct {
+	Name string `mapstructure:"name"`
+	Ipv4 string `mapstructure:"ipv4"`
+	Ipv6 string `mapstructure:"ipv6"`
 }
 
 func GetBase() *Config {
 	return baseConfig
 }
 
+// setBaseHooks 每次替换配置之后依次调用, 供其他包按新配置重建派生的数据
+var setBaseHooks []func()
+
+// OnSetBase 注册在 SetBase 之后调用的函数, 应在包初始化时注册
+func OnSetBase(fn func()) {
+	setBaseHooks = append(setBaseHooks, fn)
+}
+
+// SetBase 替换当前配置并重新生成区域列表, 测试中用来注入不读取配置文件的配置
+func SetBase(cfg *Config) {
+	baseConfig = cfg
+	zoneList = nil
+	if cfg != nil {
+		zoneList = buildZones(cfg)
+	}
+	for _, fn := range setBaseHooks {
+		fn()
+	}
+}
+
+// GetZones 返回加载配置时补全默认值的区域列表, 调用方不能修改返回的切片
+func GetZones() []ZoneConfig {
+	return zoneList
+}
+
+// buildZones 补全区域的默认值.
+// 没有配置 dns.zones 时按旧的 server.subdomain/default_ip/listen_domain 和 dns.soa/ns 生成一个区域
+func buildZones(cfg *Config) []ZoneConfig {
+	defaultTtl := uint32(60)
+	if cfg.Dns.DefaultTtl != nil {
+		defaultTtl = *cfg.Dns.DefaultTtl
+	}
+	if len(cfg.Dns.Zones) == 0 {
+		return []ZoneConfig{{
+			Name:         cfg.Server.Subdomain,
+			DefaultIp:    cfg.Server.Defaultip,
+			DefaultIpv6:  cfg.Server.Defaultipv6,
+			Ttl:          &defaultTtl,
+			Soa:          cfg.Dns.Soa,
+			Ns:           cfg.Dns.Ns,
+			ListenDomain: cfg.Server.ListenDomain,
+		}}
+	}
+	zones := make([]ZoneConfig, 0, len(cfg.Dns.Zones))
+	for _, zone := range cfg.Dns.Zones {
+		if zone.Ttl == nil {
+			zone.Ttl = &defaultTtl
+		}
+		if zone.DefaultIp == "" {
+			zone.DefaultIp = cfg.Server.Defaultip
+		}
+		if zone.DefaultIpv6 == "" {
+			zone.DefaultIpv6 = cfg.Server.Defaultipv6
+		}
+		// SOA 的计时参数沿用全局配置, mname/rname 与区域相关, 不继承
+		global := cfg.Dns.Soa
+		for _, f := range []struct{ dst, src *uint32 }{
+			{&zone.Soa.Serial, &global.Serial},
+			{&zone.Soa.Refresh, &global.Refresh},
+			{&zone.Soa.Retry, &global.Retry},
+			{&zone.Soa.Expire, &global.Expire},
+			{&zone.Soa.Ttl, &global.Ttl},
+		} {
+			if *f.dst == 0 {
+				*f.dst = *f.src
+			}
+		}
+		if zone.Soa.Minttl == nil {
+			zone.Soa.Minttl = global.Minttl
+		}
+		if zone.ListenDomain == "" {
+			zone.ListenDomain = "." + strings.TrimSuffix(zone.Name, ".")
+		}
+		zones = append(zones, zone)
+	}
+	return zones
+}
+
+// validate 检查加载配置时就能发现的错误, 避免运行时静默忽略
+func (cfg *Config) validate() error {
+	if _, err := utils.ParseCidrs(cfg.Dns.Forward.AllowFrom...); err != nil {
+		return fmt.Errorf("dns.forward.allow_from: %v", err)
+	}
+	return nil
+}
+
 func Init() error {
 	if os.Getenv("env") == "test" {
 		viper.SetConfigFile("config-test.yaml")
@@ -60,6 +292,11 @@ func Init() error {
 		fmt.Println("无法解析配置文件:", err)
 		return err
 	}
+	if err := baseConfig.validate(); err != nil {
+		fmt.Println("配置错误:", err)
+		return err
+	}
+	SetBase(baseConfig)
 
 	return nil
 }
@@ -0,0 +1,22 @@
+package config
+
+import "testing"
+
+func TestValidateAllowFrom(t *testing.T) {
+	tests := []struct {
+		allow []string
+		ok    bool
+	}{
+		{nil, true},
+		{[]string{"10.0.0.0/8", "192.0.2.7", "2001:db8::1"}, true},
+		{[]string{"10.0.0.0/33"}, false},
+		{[]string{"10.0.0.0/8", "localhost"}, false},
+	}
+	for _, tt := range tests {
+		cfg := &Config{}
+		cfg.Dns.Forward.AllowFrom = tt.allow
+		if err := cfg.validate(); (err == nil) != tt.ok {
+			t.Errorf("%v: err = %v", tt.allow, err)
+		}
+	}
+}
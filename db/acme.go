@@ -0,0 +1,66 @@
+package db
+
+import (
+	"time"
+)
+
+// AcmeAccount acme-dns 兼容接口注册的账号, 每个账号只能更新自己的子域名
+type AcmeAccount struct {
+	ID        int       `json:"id"`
+	Username  string    `json:"username"`
+	Password  string    `json:"-"`
+	Subdomain string    `json:"subdomain"`
+	AllowFrom string    `json:"allowfrom"` // JSON 数组, 允许调用 /update 的网段
+	CreatedAt time.Time `json:"createtime"`
+}
+
+// AcmeTxt 子域名的 TXT 值, 每个子域名保留最近的两条, 以便同时签发通配符和主域名证书
+type AcmeTxt struct {
+	ID         int       `json:"id"`
+	Subdomain  string    `json:"subdomain"`
+	Value      string    `json:"value"`
+	LastUpdate time.Time `json:"lastupdate"`
+}
+
+// RegisterAcmeAccount 保存账号并为其创建两条空 TXT 记录
+func (client *DBClient) RegisterAcmeAccount(account AcmeAccount) error {
+	tx := client.Client.Begin()
+	if err := tx.Create(&account).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		if err := tx.Create(&AcmeTxt{Subdomain: account.Subdomain, LastUpdate: time.Now()}).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+func (client *DBClient) GetAcmeAccount(username string) (*AcmeAccount, error) {
+	var account AcmeAccount
+	if err := client.Client.Where("username = ?", username).First(&account).Error; err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// UpdateAcmeTxt 用新值覆盖子域名最旧的一条 TXT 记录
+func (client *DBClient) UpdateAcmeTxt(subdomain string, value string) error {
+	var oldest AcmeTxt
+	if err := client.Client.Where("subdomain = ?", subdomain).Order("last_update").First(&oldest).Error; err != nil {
+		return err
+	}
+	return client.Client.Model(&oldest).Updates(map[string]interface{}{
+		"value":       value,
+		"last_update": time.Now(),
+	}).Error
+}
+
+// GetAllAcmeTxt 返回全部非空的 TXT 记录, 同一子域名内按更新时间倒序, 供 DNS 服务器加载到内存
+func (client *DBClient) GetAllAcmeTxt() ([]AcmeTxt, error) {
+	var records []AcmeTxt
+	err := client.Client.Where("value <> ''").Order("subdomain, last_update DESC").Find(&records).Error
+	return records, err
+}
@@ -3,6 +3,8 @@ package db
 import (
 	"bflog/config"
 	"bflog/utils"
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/sirupsen/logrus"
@@ -10,22 +12,160 @@ import (
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 	"gorm.io/gorm/schema"
+	"strings"
 	"time"
 )
 
 // DNSLog 数据库表的结构体
 type Dnslog struct {
-	ID          int       `json:"id"`
-	ReceiveIP   string    `json:"receiveip"`
-	QueryName   string    `json:"queryname"`
-	QueryType   string    `json:"querytype"`
+	ID        int    `json:"id"`
+	ReceiveIP string `json:"receiveip"`
+	QueryName string `json:"queryname"`
+	// RawName 为查询中的原始名称, 保留解析器 0x20 随机化后的大小写
+	RawName       string `json:"rawname"`
+	QueryType     string `json:"querytype"`
+	QueryClass    string `json:"queryclass"`
+	TransactionID int    `json:"txid"`
+	// RD/CD/DO 标志位
+	RecursionDesired bool `json:"rd"`
+	CheckingDisabled bool `json:"cd"`
+	DnssecOK         bool `json:"do"`
+	EdnsSize         int  `json:"edns_size"`
+	// ClientSubnet 为 EDNS Client Subnet, 通常能看到公共解析器背后的真实网段
+	ClientSubnet string `json:"client_subnet"`
+	Transport    string `json:"transport"`
+	// Ttl 应答记录的最小 TTL, 否定应答为 SOA 的否定缓存时间
+	Ttl uint32 `json:"ttl"`
+	// Zone 查询命中的权威区域
+	Zone string `json:"zone"`
+	// Noise 命中噪音规则的记录, 默认不在列表中显示
+	Noise bool `json:"noise"`
+	// ResolverTag 来源地址所属的公共解析器, 为空表示不是已知的公共解析器
+	ResolverTag string `json:"resolver"`
+	// Probe 这次应答实际使用的探测方式, ProbeID 关联同一次探测触发的后续查询
+	Probe   string `json:"probe"`
+	ProbeID string `json:"probe_id"`
+	// Answer 为实际返回的应答记录, 没有记录时为响应码
+	Answer      string    `json:"answer"`
 	CreatedTime time.Time `json:"createtime"`
 }
 
+// DnsRule 的 IPAddresses 为记录值列表, 含义由 Type 决定:
+// A/AAAA 为 IP, TXT 为文本, CNAME 为目标域名, MX 为 "优先级 主机"
 type DnsRule struct {
-	ID          int    `json:"id"`
-	Name        string `json:"name"`
-	IPAddresses string `json:"ip_addresses"`
+	ID          int           `json:"id"`
+	Name        string        `json:"name"`
+	Type        string        `json:"type"`
+	IPAddresses DnsRuleValues `json:"ip_addresses"`
+	// Strategy 为 A/AAAA 记录的 rebinding 策略, StrategyArg 为策略参数(次数或秒数)
+	Strategy    string `json:"strategy"`
+	StrategyArg int    `json:"strategy_arg"`
+	// MatchType 为 exact/wildcard/regex, 留空时以 "*." 开头的名称视为 wildcard;
+	// Priority 决定 regex 规则的匹配顺序, 越小越优先
+	MatchType string `json:"match_type"`
+	Priority  int    `json:"priority"`
+	// Ttl 应答的 TTL, 为空时轮换多个地址的 A/AAAA 规则使用 0, 其他规则使用区域的默认 TTL
+	Ttl *uint32 `json:"ttl"`
+	// Probe 解析器行为探测方式(truncate/delay/servfail/refused/oversize/compress), ProbeArg 为毫秒数或记录数
+	Probe    string `json:"probe"`
+	ProbeArg int    `json:"probe_arg"`
+}
+
+// DnsRuleValues 规则的记录值列表, 在 ip_addresses 列中保存为 JSON 数组, TXT 记录值可以包含逗号.
+// 旧版本写入的逗号分隔字符串在读取时按逗号拆分
+type DnsRuleValues []string
+
+// Scan 实现 sql.Scanner
+func (v *DnsRuleValues) Scan(src interface{}) error {
+	var raw string
+	switch s := src.(type) {
+	case nil:
+		*v = nil
+		return nil
+	case []byte:
+		raw = string(s)
+	case string:
+		raw = s
+	default:
+		return fmt.Errorf("unsupported dns rule values type %T", src)
+	}
+	if strings.HasPrefix(strings.TrimSpace(raw), "[") {
+		var values []string
+		if err := json.Unmarshal([]byte(raw), &values); err != nil {
+			return err
+		}
+		*v = values
+		return nil
+	}
+	*v = splitRuleValues(raw)
+	return nil
+}
+
+// Value 实现 driver.Valuer
+func (v DnsRuleValues) Value() (driver.Value, error) {
+	if v == nil {
+		v = DnsRuleValues{}
+	}
+	data, err := json.Marshal([]string(v))
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// UnmarshalJSON 接受字符串数组, 也兼容旧接口的逗号分隔字符串
+func (v *DnsRuleValues) UnmarshalJSON(data []byte) error {
+	var raw string
+	if err := json.Unmarshal(data, &raw); err == nil {
+		*v = splitRuleValues(raw)
+		return nil
+	}
+	var values []string
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	*v = values
+	return nil
+}
+
+// Trimmed 返回去掉首尾空白和空值之后的记录值
+func (v DnsRuleValues) Trimmed() []string {
+	var values []string
+	for _, value := range v {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func splitRuleValues(raw string) DnsRuleValues {
+	if strings.TrimSpace(raw) == "" {
+		return nil
+	}
+	return strings.Split(raw, ",")
+}
+
+// DnsRuleTypes 规则支持的记录类型
+var DnsRuleTypes = []string{"A", "AAAA", "TXT", "CNAME", "MX"}
+
+// IsDnsRuleType 判断记录类型是否受支持
+func IsDnsRuleType(rtype string) bool {
+	for _, t := range DnsRuleTypes {
+		if t == rtype {
+			return true
+		}
+	}
+	return false
+}
+
+// DnsRuleKey 返回规则在规则表中的 key, 同一域名的不同记录类型互不冲突
+func DnsRuleKey(name string, rtype string) string {
+	rtype = strings.ToUpper(rtype)
+	if rtype == "" || rtype == "A" {
+		return name
+	}
+	return name + "|" + rtype
 }
 
 type User struct {
@@ -41,7 +181,15 @@ type HttpResponse struct {
 	RedirectUrl string `json:"redirecturl"`
 	Header      string `json:"header"`
 	Body        string `json:"body"`
-	Method      string `json:"method"`
+	// Method 为 ANY 时匹配所有请求方法
+	Method string `json:"method"`
+	// MatchType 为 exact/prefix/glob/regex, 留空时为 exact; regex 中的命名分组作为路径参数.
+	// Priority 越小越优先, 相同时按 exact, 最长的 prefix, glob, regex 的顺序
+	MatchType string `json:"match_type"`
+	Priority  int    `json:"priority"`
+	// Hostname 为空时匹配所有域名, 否则为精确域名, *.example.com 形式的通配符,
+	// 或者不含点的 token, 匹配任意区域下的 token 子域名
+	Hostname string `json:"hostname"`
 	//CreatedAt   time.Time `json:"createtime"`
 }
 
@@ -55,12 +203,29 @@ type HttpRequestLog struct {
 	Header     string    `json:"header"`
 	Body       string    `json:"body"`
 	Path       string    `json:"path"`
+	// Zone Host 命中的区域
+	Zone  string `json:"zone"`
+	Noise bool   `json:"noise"`
+	// RequestID 每个请求生成的 id, 响应模板中可以通过 {{.RequestID}} 引用
+	RequestID string `json:"request_id"`
+	// HTTPS 请求的 ClientHello 信息, Alpn 和 TlsCiphers 为客户端提供的列表, TlsVersion 为协商出的版本.
+	// 握手失败的连接也会记录, 此时只有这些字段和 TlsError
+	Sni        string `json:"sni"`
+	Alpn       string `json:"alpn"`
+	TlsVersion string `json:"tls_version"`
+	TlsCiphers string `json:"tls_ciphers"`
+	Ja3        string `json:"ja3"`
+	Ja4        string `json:"ja4"`
+	TlsError   string `json:"tls_error"`
 }
 
 // DBClient 封装数据库客户端的结构体
 type DBClient struct {
 	Client   *gorm.DB
-	InsertCh chan Dnslog // 通道用于传递要插入的记录
+	InsertCh chan Dnslog     // 通道用于传递要插入的记录
+	ExfilCh  chan ExfilChunk // 通道用于传递外带数据分片
+	// ForwardCh 用于传递转发查询的记录
+	ForwardCh chan ForwardLog
 }
 
 // 全局 DBClient 实例
@@ -98,12 +263,23 @@ func InitDB() {
 
 	// 创建全局 DBClient 实例
 	dbClient = &DBClient{
-		Client:   db,
-		InsertCh: make(chan Dnslog, 100), // 初始化带缓冲区的通道
+		Client:    db,
+		InsertCh:  make(chan Dnslog, insertQueueSize()), // 初始化带缓冲区的通道
+		ExfilCh:   make(chan ExfilChunk, 100),
+		ForwardCh: make(chan ForwardLog, 1000),
 	}
 
 	// 启动异步插入
 	go dbClient.asyncInsertWorker()
+	go dbClient.exfilInsertWorker()
+	go dbClient.forwardInsertWorker()
+	if err := dbClient.ReloadNoiseRules(); err != nil {
+		logrus.Errorf("load noise rules: %v", err)
+	}
+	go dbClient.refreshNoiseRules()
+	if overflowPolicy() == OverflowSpool {
+		go dbClient.replaySpool()
+	}
 }
 
 // GetDB 返回全局 DBClient 实例
@@ -111,30 +287,16 @@ func GetDB() *DBClient {
 	return dbClient
 }
 
-// AsyncInsertWorker 处理从通道中接收的 DNS 记录并插入到数据库中
-func (client *DBClient) asyncInsertWorker() {
-	for record := range client.InsertCh {
-		//logrus.Infof("Inserting record into database: %+v", record)
-		result := client.Client.Create(&record)
-		if result.Error != nil {
-			logrus.Error(result.Error)
-		}
-	}
-}
-
-// InsertRecord 异步将 DNS 记录发送到通道
-func (client *DBClient) InsertRecord(record Dnslog) {
-	select {
-	case client.InsertCh <- record: // 发送记录到通道
-		logrus.Infof("Record inserted into channel: %+v", record)
-	default:
-		logrus.Warnf("Insert channel is full, dropping record: %+v", record)
-	}
+// SetDB 替换全局 DBClient 实例, 测试中用来注入只带通道的实例
+func SetDB(client *DBClient) {
+	dbClient = client
 }
 
 // 优雅关闭通道，在需要关闭时调用
 func (client *DBClient) Close() {
 	close(client.InsertCh)
+	close(client.ExfilCh)
+	close(client.ForwardCh)
 	logrus.Info("Insert channel closed.")
 }
 
@@ -142,31 +304,78 @@ func (client *DBClient) InsertLog(log HttpRequestLog) error {
 	return client.Client.Create(&log).Error
 }
 
-func (client *DBClient) GetHttpResponse(path string, method string) (*HttpResponse, error) {
-	var response HttpResponse
-	result := client.Client.Where("path = ? and method = ?", path, method).First(&response)
-	if result.Error != nil {
-		return nil, result.Error
+// GetAllHttpResponses 返回全部 HTTP 响应规则, 供 HTTP 服务器加载到内存
+func (client *DBClient) GetAllHttpResponses() ([]HttpResponse, error) {
+	var rules []HttpResponse
+	if err := client.Client.Find(&rules).Error; err != nil {
+		return nil, err
 	}
-	return &response, nil
+	return rules, nil
+}
+
+// applyDnslogFilter 添加 dnslog 的过滤条件, 明细和聚合查询共用
+func applyDnslogFilter(query *gorm.DB, dnsFilter *utils.DnslogFilter) *gorm.DB {
+	if dnsFilter.ReceiveIP != "" {
+		query = query.Where("receive_ip LIKE ?", "%"+dnsFilter.ReceiveIP+"%")
+	}
+	if dnsFilter.QueryName != "" {
+		query = query.Where("query_name LIKE ?", "%"+dnsFilter.QueryName+"%")
+	}
+	if dnsFilter.QueryType != "" {
+		query = query.Where("query_type LIKE ?", "%"+dnsFilter.QueryType+"%")
+	}
+	if dnsFilter.RawName != "" {
+		query = query.Where("raw_name LIKE BINARY ?", "%"+dnsFilter.RawName+"%")
+	}
+	if dnsFilter.QueryClass != "" {
+		query = query.Where("query_class = ?", dnsFilter.QueryClass)
+	}
+	if dnsFilter.TransactionID != nil {
+		query = query.Where("transaction_id = ?", *dnsFilter.TransactionID)
+	}
+	if dnsFilter.RecursionDesired != nil {
+		query = query.Where("recursion_desired = ?", *dnsFilter.RecursionDesired)
+	}
+	if dnsFilter.CheckingDisabled != nil {
+		query = query.Where("checking_disabled = ?", *dnsFilter.CheckingDisabled)
+	}
+	if dnsFilter.DnssecOK != nil {
+		query = query.Where("dnssec_ok = ?", *dnsFilter.DnssecOK)
+	}
+	if dnsFilter.ClientSubnet != "" {
+		query = query.Where("client_subnet LIKE ?", "%"+dnsFilter.ClientSubnet+"%")
+	}
+	if dnsFilter.Transport != "" {
+		query = query.Where("transport = ?", dnsFilter.Transport)
+	}
+	query = query.Where("noise = ?", dnsFilter.Noise)
+	if dnsFilter.Zone != "" {
+		query = query.Where("zone = ?", dnsFilter.Zone)
+	}
+	if dnsFilter.Resolver == "unknown" {
+		query = query.Where("resolver_tag = ''")
+	} else if dnsFilter.Resolver != "" {
+		query = query.Where("resolver_tag = ?", dnsFilter.Resolver)
+	}
+	if dnsFilter.Answer != "" {
+		query = query.Where("answer LIKE ?", "%"+dnsFilter.Answer+"%")
+	}
+	if dnsFilter.Probe != "" {
+		query = query.Where("probe = ?", dnsFilter.Probe)
+	}
+	if dnsFilter.ProbeID != "" {
+		query = query.Where("probe_id = ?", dnsFilter.ProbeID)
+	}
+	return query
 }
 
 // 查询dnslog
-func (client *DBClient) GetDnslog(receiveIP string, queryName string, queryType string, filter *utils.PaginationAndTimeFilter) ([]Dnslog, int, error) {
+func (client *DBClient) GetDnslog(dnsFilter *utils.DnslogFilter, filter *utils.PaginationAndTimeFilter) ([]Dnslog, int, error) {
 	var logs []Dnslog
 	var totalCount int64
 	query := client.Client.Model(&Dnslog{})
 
-	// 添加过滤条件
-	if receiveIP != "" {
-		query = query.Where("receive_ip LIKE ?", "%"+receiveIP+"%")
-	}
-	if queryName != "" {
-		query = query.Where("query_name LIKE ?", "%"+queryName+"%")
-	}
-	if queryType != "" {
-		query = query.Where("query_type LIKE ?", "%"+queryType+"%")
-	}
+	query = applyDnslogFilter(query, dnsFilter)
 
 	countQuery := query.Session(&gorm.Session{})
 
@@ -242,9 +451,10 @@ func (client *DBClient) DeleteHttpLogsByIds(ids []int) error {
 	return client.Client.Where("id IN (?)", ids).Delete(&HttpRequestLog{}).Error
 }
 
-func (client *DBClient) GetHttplog(hostname string, remoteaddr string, method string, url string, header string, body string, path string, filter *utils.PaginationAndTimeFilter) ([]HttpRequestLog, int, error) {
+// GetHttplog 查询 http 日志, noise 为 true 时只返回命中噪音规则的记录
+func (client *DBClient) GetHttplog(hostname string, remoteaddr string, method string, url string, header string, body string, path string, noise bool, filter *utils.PaginationAndTimeFilter) ([]HttpRequestLog, int, error) {
 	var logs []HttpRequestLog
-	query := client.Client.Model(&HttpRequestLog{})
+	query := client.Client.Model(&HttpRequestLog{}).Where("noise = ?", noise)
 	var totalCount int64
 	// 添加过滤条件
 	if hostname != "" {
@@ -360,6 +570,32 @@ func (client *DBClient) Getdnsrule(name string, filter *utils.PaginationAndTimeF
 	return result, int(totalCount), nil
 }
 
+// GetAllDnsRules 返回全部 DNS 规则, 供 DNS 服务器加载到内存
+func (client *DBClient) GetAllDnsRules() ([]DnsRule, error) {
+	var rules []DnsRule
+	if err := client.Client.Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// SaveDnsRules 在一个事务中新增和更新规则, 用于批量导入
+func (client *DBClient) SaveDnsRules(created []DnsRule, updated []DnsRule) error {
+	return client.Client.Transaction(func(tx *gorm.DB) error {
+		if len(created) > 0 {
+			if err := tx.Create(&created).Error; err != nil {
+				return err
+			}
+		}
+		for i := range updated {
+			if err := tx.Save(&updated[i]).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 func (client *DBClient) adddnsrule(rule DnsRule) error {
 	return client.Client.Create(&rule).Error
 }
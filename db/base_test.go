@@ -0,0 +1,66 @@
+package db
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDnsRuleValuesScan(t *testing.T) {
+	tests := []struct {
+		src  interface{}
+		want DnsRuleValues
+	}{
+		{[]byte(`["v=spf1 a,b -all","second"]`), DnsRuleValues{"v=spf1 a,b -all", "second"}},
+		// 旧版本的逗号分隔字符串
+		{"1.2.3.4,5.6.7.8", DnsRuleValues{"1.2.3.4", "5.6.7.8"}},
+		{"", nil},
+		{nil, nil},
+	}
+	for _, tt := range tests {
+		var got DnsRuleValues
+		if err := got.Scan(tt.src); err != nil {
+			t.Fatalf("Scan(%v): %v", tt.src, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Scan(%v) = %q, want %q", tt.src, []string(got), []string(tt.want))
+		}
+	}
+
+	value, err := DnsRuleValues{"a,b", "c"}.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back DnsRuleValues
+	if err := back.Scan(value); err != nil || !reflect.DeepEqual(back, DnsRuleValues{"a,b", "c"}) {
+		t.Errorf("round trip %v = %q, %v", value, []string(back), err)
+	}
+}
+
+func TestDnsRuleValuesJSON(t *testing.T) {
+	var rule DnsRule
+	if err := json.Unmarshal([]byte(`{"type":"TXT","ip_addresses":["a,b","c"]}`), &rule); err != nil {
+		t.Fatal(err)
+	}
+	if want := (DnsRuleValues{"a,b", "c"}); !reflect.DeepEqual(rule.IPAddresses, want) {
+		t.Errorf("array = %q", []string(rule.IPAddresses))
+	}
+	// 兼容旧接口的逗号分隔字符串
+	if err := json.Unmarshal([]byte(`{"ip_addresses":"1.2.3.4,5.6.7.8"}`), &rule); err != nil {
+		t.Fatal(err)
+	}
+	if want := (DnsRuleValues{"1.2.3.4", "5.6.7.8"}); !reflect.DeepEqual(rule.IPAddresses, want) {
+		t.Errorf("string = %q", []string(rule.IPAddresses))
+	}
+	data, err := json.Marshal(DnsRule{IPAddresses: DnsRuleValues{"a,b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out map[string]interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := out["ip_addresses"].([]interface{}); !ok || len(got) != 1 || got[0] != "a,b" {
+		t.Errorf("marshal = %s", data)
+	}
+}
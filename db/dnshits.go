@@ -0,0 +1,108 @@
+package db
+
+import (
+	"bflog/utils"
+	"fmt"
+	"gorm.io/gorm"
+	"net"
+	"strings"
+	"time"
+)
+
+// DnslogHit 同一个查询名, 解析器和类型在一个时间窗口内的多条 dnslog 合并后的结果.
+// 一次 SSRF 通常因为解析器重试, A/AAAA 和多个解析器产生多条记录.
+// 公共解析器按 resolver_tag 合并同一服务的多个出口地址, 未识别的来源按地址分别统计
+type DnslogHit struct {
+	QueryName string    `json:"queryname"`
+	QueryType string    `json:"querytype"`
+	Resolver  string    `json:"resolver"`
+	Zone      string    `json:"zone"`
+	Hits      int       `json:"hits"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	// ResolverIPs 发起查询的不同解析器地址(去掉端口), DistinctResolvers 为其数量
+	ResolverIPs       []string `json:"resolver_ips"`
+	DistinctResolvers int      `json:"distinct_resolvers"`
+}
+
+// dnslogHitRow 聚合查询的原始结果, receive_ip 为 GROUP_CONCAT 拼接的地址
+type dnslogHitRow struct {
+	QueryName  string
+	QueryType  string
+	Resolver   string
+	Zone       string
+	Hits       int
+	FirstSeen  time.Time
+	LastSeen   time.Time
+	ReceiveIPs string
+}
+
+// resolverGroupExpr 聚合时的解析器分组: 有 resolver_tag 时为 tag, 否则为去掉端口的 receive_ip.
+// receive_ip 可能是 1.2.3.4:53, [2001:db8::1]:53, 以及 DoH 经过 Nginx 时不带端口的地址
+const resolverGroupExpr = "CASE WHEN resolver_tag <> '' THEN resolver_tag " +
+	"WHEN receive_ip LIKE '[%' THEN SUBSTRING_INDEX(SUBSTRING_INDEX(receive_ip, ']', 1), '[', -1) " +
+	"WHEN receive_ip LIKE '%:%:%' THEN receive_ip " +
+	"ELSE SUBSTRING_INDEX(receive_ip, ':', 1) END"
+
+// GetDnslogHits 按 (查询名, 解析器, 类型) 以及 window 秒的时间窗口聚合 dnslog, window 为 0 时不分窗口.
+// 解析器按 resolverGroupExpr 分组, 未识别的解析器不会合并到一起.
+// 窗口是从 Unix 纪元开始按 window 秒对齐的固定区间 FLOOR(unix_time / window), 不是滑动窗口,
+// 跨过区间边界的一次突发会拆成相邻的两行. 过滤条件与 GetDnslog 相同, 结果按最后一次出现的时间倒序
+func (client *DBClient) GetDnslogHits(dnsFilter *utils.DnslogFilter, window int, filter *utils.PaginationAndTimeFilter) ([]DnslogHit, int, error) {
+	query := applyDnslogFilter(client.Client.Model(&Dnslog{}), dnsFilter)
+	if !filter.StartTime.IsZero() {
+		query = query.Where("created_time >= ?", filter.StartTime)
+	}
+	if !filter.EndTime.IsZero() {
+		query = query.Where("created_time <= ?", filter.EndTime)
+	}
+	group := "query_name, query_type, " + resolverGroupExpr
+	if window > 0 {
+		group += fmt.Sprintf(", FLOOR(UNIX_TIMESTAMP(created_time) / %d)", window)
+	}
+
+	var totalCount int64
+	countQuery := client.Client.Table("(?) AS hits", query.Session(&gorm.Session{}).Select("1").Group(group))
+	if err := countQuery.Count(&totalCount).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var rows []dnslogHitRow
+	err := query.Select("query_name, query_type, MAX(resolver_tag) AS resolver, MAX(zone) AS zone, COUNT(*) AS hits, " +
+		"MIN(created_time) AS first_seen, MAX(created_time) AS last_seen, " +
+		"GROUP_CONCAT(DISTINCT receive_ip SEPARATOR ',') AS receive_ips").
+		Group(group).Order("last_seen DESC").
+		Offset((filter.Page - 1) * filter.PageSize).Limit(filter.PageSize).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	hits := make([]DnslogHit, 0, len(rows))
+	for _, row := range rows {
+		hit := DnslogHit{
+			QueryName:   row.QueryName,
+			QueryType:   row.QueryType,
+			Resolver:    row.Resolver,
+			Zone:        row.Zone,
+			Hits:        row.Hits,
+			FirstSeen:   row.FirstSeen,
+			LastSeen:    row.LastSeen,
+			ResolverIPs: []string{},
+		}
+		// receive_ip 带端口, 同一个解析器换了源端口也只算一次
+		seen := make(map[string]bool)
+		for _, addr := range strings.Split(row.ReceiveIPs, ",") {
+			if host, _, err := net.SplitHostPort(addr); err == nil {
+				addr = host
+			}
+			if addr != "" && !seen[addr] {
+				seen[addr] = true
+				hit.ResolverIPs = append(hit.ResolverIPs, addr)
+			}
+		}
+		hit.DistinctResolvers = len(hit.ResolverIPs)
+		hits = append(hits, hit)
+	}
+	return hits, int(totalCount), nil
+}
@@ -0,0 +1,87 @@
+package db
+
+import (
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+// ExfilChunk 通过 DNS label 外带的一个数据分片, (token, seq) 唯一, 解析器重复发送的查询会被忽略
+type ExfilChunk struct {
+	ID          int       `json:"id"`
+	Token       string    `json:"token"`
+	Seq         int       `json:"seq"`
+	Total       int       `json:"total"`
+	Data        string    `json:"data"`
+	ReceiveIP   string    `json:"receiveip"`
+	CreatedTime time.Time `json:"createtime"`
+}
+
+// ExfilSession 按 token 汇总的外带会话
+type ExfilSession struct {
+	Token     string    `json:"token"`
+	Chunks    int       `json:"chunks"`
+	MinSeq    int       `json:"min_seq"`
+	MaxSeq    int       `json:"max_seq"`
+	Total     int       `json:"total"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// exfilInsertWorker 处理通道中的分片并写入数据库
+func (client *DBClient) exfilInsertWorker() {
+	for chunk := range client.ExfilCh {
+		result := client.Client.Clauses(clause.OnConflict{DoNothing: true}).Create(&chunk)
+		if result.Error != nil {
+			logrus.Error(result.Error)
+		}
+	}
+}
+
+// InsertExfilChunk 异步将分片发送到通道
+func (client *DBClient) InsertExfilChunk(chunk ExfilChunk) {
+	select {
+	case client.ExfilCh <- chunk:
+	default:
+		logrus.Warnf("Exfil channel is full, dropping chunk: %+v", chunk)
+	}
+}
+
+// GetExfilSessions 分页查询外带会话, 按最后收到分片的时间倒序
+func (client *DBClient) GetExfilSessions(token string, page int, pageSize int) ([]ExfilSession, int, error) {
+	var sessions []ExfilSession
+	var totalCount int64
+	query := client.Client.Model(&ExfilChunk{})
+	if token != "" {
+		query = query.Where("token LIKE ?", "%"+token+"%")
+	}
+	if err := query.Distinct("token").Count(&totalCount).Error; err != nil {
+		return nil, 0, err
+	}
+	query = client.Client.Model(&ExfilChunk{})
+	if token != "" {
+		query = query.Where("token LIKE ?", "%"+token+"%")
+	}
+	err := query.Select("token, COUNT(*) AS chunks, MIN(seq) AS min_seq, MAX(seq) AS max_seq, " +
+		"MAX(total) AS total, MIN(created_time) AS first_seen, MAX(created_time) AS last_seen").
+		Group("token").Order("last_seen DESC").
+		Offset((page - 1) * pageSize).Limit(pageSize).
+		Scan(&sessions).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return sessions, int(totalCount), nil
+}
+
+// GetExfilChunks 按序号返回某个 token 的全部分片
+func (client *DBClient) GetExfilChunks(token string) ([]ExfilChunk, error) {
+	var chunks []ExfilChunk
+	if err := client.Client.Where("token = ?", token).Order("seq").Find(&chunks).Error; err != nil {
+		return nil, err
+	}
+	return chunks, nil
+}
+
+func (client *DBClient) DeleteExfilSession(token string) error {
+	return client.Client.Where("token = ?", token).Delete(&ExfilChunk{}).Error
+}
@@ -0,0 +1,77 @@
+package db
+
+import (
+	"bflog/utils"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"time"
+)
+
+// ForwardLog 转发到上游的区域外查询, 与 dnslog 分开保存
+type ForwardLog struct {
+	ID        int    `json:"id"`
+	ReceiveIP string `json:"receiveip"`
+	QueryName string `json:"queryname"`
+	QueryType string `json:"querytype"`
+	Transport string `json:"transport"`
+	// Upstream 实际应答的上游, 命中缓存时为空
+	Upstream string `json:"upstream"`
+	Cached   bool   `json:"cached"`
+	Rcode    string `json:"rcode"`
+	Answer   string `json:"answer"`
+	// Duration 查询上游花费的毫秒数
+	Duration    int       `json:"duration"`
+	CreatedTime time.Time `json:"createtime"`
+}
+
+// forwardInsertWorker 处理通道中的转发记录并写入数据库
+func (client *DBClient) forwardInsertWorker() {
+	for record := range client.ForwardCh {
+		if err := client.Client.Create(&record).Error; err != nil {
+			logrus.Error(err)
+		}
+	}
+}
+
+// InsertForwardLog 异步将转发记录发送到通道, 通道满时丢弃
+func (client *DBClient) InsertForwardLog(record ForwardLog) {
+	select {
+	case client.ForwardCh <- record:
+	default:
+		logrus.Warnf("Forward log channel is full, dropping %s %s", record.QueryName, record.QueryType)
+	}
+}
+
+// GetForwardLogs 分页查询转发记录, 按时间倒序
+func (client *DBClient) GetForwardLogs(receiveIP string, queryName string, upstream string, filter *utils.PaginationAndTimeFilter) ([]ForwardLog, int, error) {
+	var logs []ForwardLog
+	var totalCount int64
+	query := client.Client.Model(&ForwardLog{})
+	if receiveIP != "" {
+		query = query.Where("receive_ip LIKE ?", "%"+receiveIP+"%")
+	}
+	if queryName != "" {
+		query = query.Where("query_name LIKE ?", "%"+queryName+"%")
+	}
+	if upstream != "" {
+		query = query.Where("upstream = ?", upstream)
+	}
+	if !filter.StartTime.IsZero() {
+		query = query.Where("created_time >= ?", filter.StartTime)
+	}
+	if !filter.EndTime.IsZero() {
+		query = query.Where("created_time <= ?", filter.EndTime)
+	}
+	if err := query.Session(&gorm.Session{}).Count(&totalCount).Error; err != nil {
+		return nil, 0, err
+	}
+	err := query.Order("id DESC").Offset((filter.Page - 1) * filter.PageSize).Limit(filter.PageSize).Find(&logs).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return logs, int(totalCount), nil
+}
+
+func (client *DBClient) DeleteAllForwardLogs() error {
+	return client.Client.Where("1 = 1").Delete(&ForwardLog{}).Error
+}
@@ -0,0 +1,220 @@
+package db
+
+import (
+	"bflog/config"
+	"bufio"
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 写库队列满时的处理策略
+const (
+	OverflowDrop   = "drop"
+	OverflowSample = "sample"
+	OverflowSpool  = "spool"
+)
+
+const (
+	// insertBatchSize 每次批量写入的最大记录数
+	insertBatchSize = 200
+	// spoolReplayInterval 检查 spool 文件并补录的间隔
+	spoolReplayInterval = 5 * time.Second
+)
+
+// InsertStats dnslog 写库队列的统计
+type InsertStats struct {
+	Policy   string `json:"policy"`
+	QueueLen int    `json:"queue_len"`
+	QueueCap int    `json:"queue_cap"`
+	Queued   int64  `json:"queued"`
+	Inserted int64  `json:"inserted"`
+	Failed   int64  `json:"failed"`
+	Dropped  int64  `json:"dropped"`
+	Sampled  int64  `json:"sampled"`
+	Spooled  int64  `json:"spooled"`
+	Replayed int64  `json:"replayed"`
+}
+
+var insertCounters struct {
+	queued, inserted, failed, dropped, sampled, spooled, replayed, sampleSeq atomic.Int64
+}
+
+// spoolMu 保护 spool 文件的追加和轮换
+var spoolMu sync.Mutex
+
+func insertQueueSize() int {
+	if n := config.GetBase().Dns.Persist.Queue; n > 0 {
+		return n
+	}
+	return 10000
+}
+
+func overflowPolicy() string {
+	switch policy := config.GetBase().Dns.Persist.Policy; policy {
+	case OverflowSample, OverflowSpool:
+		return policy
+	}
+	return OverflowDrop
+}
+
+func spoolFile() string {
+	if file := config.GetBase().Dns.Persist.SpoolFile; file != "" {
+		return file
+	}
+	return "dnslog.spool"
+}
+
+// createDnslogs 批量写入记录, 测试中替换为不需要数据库的实现
+var createDnslogs = func(client *DBClient, batch []Dnslog) error {
+	return client.Client.Create(&batch).Error
+}
+
+// asyncInsertWorker 处理从通道中接收的 DNS 记录并批量插入到数据库中
+func (client *DBClient) asyncInsertWorker() {
+	batch := make([]Dnslog, 0, insertBatchSize)
+	for record := range client.InsertCh {
+		batch = append(batch[:0], record)
+		// 顺带取出队列中已有的记录, 一次写入减少往返
+	drain:
+		for len(batch) < insertBatchSize {
+			select {
+			case record, ok := <-client.InsertCh:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, record)
+			default:
+				break drain
+			}
+		}
+		if err := createDnslogs(client, batch); err != nil {
+			insertCounters.failed.Add(int64(len(batch)))
+			logrus.Error(err)
+			continue
+		}
+		insertCounters.inserted.Add(int64(len(batch)))
+	}
+}
+
+// InsertRecord 将 DNS 记录发送到写库队列, 永远不会阻塞调用方
+func (client *DBClient) InsertRecord(record Dnslog) {
+	policy := overflowPolicy()
+	if policy == OverflowSample && len(client.InsertCh) >= cap(client.InsertCh)*3/4 {
+		// 队列接近满时只保留 1/SampleRate 的记录
+		rate := int64(config.GetBase().Dns.Persist.SampleRate)
+		if rate > 1 && insertCounters.sampleSeq.Add(1)%rate != 0 {
+			insertCounters.sampled.Add(1)
+			return
+		}
+	}
+	select {
+	case client.InsertCh <- record: // 发送记录到通道
+		insertCounters.queued.Add(1)
+	default:
+		if policy == OverflowSpool && spoolRecord(record) == nil {
+			insertCounters.spooled.Add(1)
+			return
+		}
+		insertCounters.dropped.Add(1)
+	}
+}
+
+// spoolRecord 把记录以 JSON 行追加到 spool 文件
+func spoolRecord(record Dnslog) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	spoolMu.Lock()
+	defer spoolMu.Unlock()
+	f, err := os.OpenFile(spoolFile(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		logrus.Errorf("spool dnslog: %v", err)
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// replaySpool 队列空闲时把 spool 文件中的记录补录到数据库
+func (client *DBClient) replaySpool() {
+	ticker := time.NewTicker(spoolReplayInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		client.replaySpoolOnce()
+	}
+}
+
+// replaySpoolOnce 队列使用不到 1/4 时补录一次 spool 文件
+func (client *DBClient) replaySpoolOnce() {
+	if len(client.InsertCh) > cap(client.InsertCh)/4 {
+		return
+	}
+	// 先改名再读取, 补录期间新溢出的记录写入新的 spool 文件
+	replayFile := spoolFile() + ".replay"
+	spoolMu.Lock()
+	err := os.Rename(spoolFile(), replayFile)
+	spoolMu.Unlock()
+	if err != nil {
+		return
+	}
+	if err := client.replaySpoolFile(replayFile); err != nil {
+		logrus.Errorf("replay dnslog spool: %v", err)
+	}
+}
+
+func (client *DBClient) replaySpoolFile(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file)
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	batch := make([]Dnslog, 0, insertBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := createDnslogs(client, batch); err != nil {
+			insertCounters.failed.Add(int64(len(batch)))
+			logrus.Error(err)
+		} else {
+			insertCounters.replayed.Add(int64(len(batch)))
+		}
+		batch = batch[:0]
+	}
+	for scanner.Scan() {
+		var record Dnslog
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		batch = append(batch, record)
+		if len(batch) == insertBatchSize {
+			flush()
+		}
+	}
+	flush()
+	return scanner.Err()
+}
+
+// InsertStats 返回写库队列的统计
+func (client *DBClient) InsertStats() InsertStats {
+	return InsertStats{
+		Policy:   overflowPolicy(),
+		QueueLen: len(client.InsertCh),
+		QueueCap: cap(client.InsertCh),
+		Queued:   insertCounters.queued.Load(),
+		Inserted: insertCounters.inserted.Load(),
+		Failed:   insertCounters.failed.Load(),
+		Dropped:  insertCounters.dropped.Load(),
+		Sampled:  insertCounters.sampled.Load(),
+		Spooled:  insertCounters.spooled.Load(),
+		Replayed: insertCounters.replayed.Load(),
+	}
+}
@@ -0,0 +1,143 @@
+package db
+
+import (
+	"bflog/config"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+// setupInsert 使用只包含写库队列配置的 config, 清空统计, 返回队列容量为 queue 的 DBClient
+func setupInsert(t *testing.T, policy string, sampleRate int, queue int) *DBClient {
+	t.Helper()
+	cfg := &config.Config{}
+	cfg.Dns.Persist.Policy = policy
+	cfg.Dns.Persist.SampleRate = sampleRate
+	cfg.Dns.Persist.SpoolFile = filepath.Join(t.TempDir(), "dnslog.spool")
+	config.SetBase(cfg)
+	t.Cleanup(func() { config.SetBase(nil) })
+	for _, counter := range []*atomic.Int64{
+		&insertCounters.queued, &insertCounters.inserted, &insertCounters.failed, &insertCounters.dropped,
+		&insertCounters.sampled, &insertCounters.spooled, &insertCounters.replayed, &insertCounters.sampleSeq,
+	} {
+		counter.Store(0)
+	}
+	return &DBClient{InsertCh: make(chan Dnslog, queue)}
+}
+
+// insertN 依次写入名为 r0 ... r<n-1> 的记录
+func insertN(client *DBClient, n int) {
+	for i := 0; i < n; i++ {
+		client.InsertRecord(Dnslog{QueryName: fmt.Sprintf("r%d", i)})
+	}
+}
+
+// drainQueue 取出队列中的全部记录名
+func drainQueue(client *DBClient) []string {
+	var names []string
+	for len(client.InsertCh) > 0 {
+		names = append(names, (<-client.InsertCh).QueryName)
+	}
+	return names
+}
+
+func recordNames(n ...int) []string {
+	var names []string
+	for _, i := range n {
+		names = append(names, fmt.Sprintf("r%d", i))
+	}
+	return names
+}
+
+func TestInsertOverflowDrop(t *testing.T) {
+	client := setupInsert(t, "", 0, 4)
+	insertN(client, 6)
+	if got, want := drainQueue(client), recordNames(0, 1, 2, 3); !reflect.DeepEqual(got, want) {
+		t.Errorf("queued %v, want %v", got, want)
+	}
+	stats := client.InsertStats()
+	if stats.Policy != OverflowDrop || stats.Queued != 4 || stats.Dropped != 2 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestInsertOverflowSample(t *testing.T) {
+	client := setupInsert(t, OverflowSample, 3, 8)
+	// 队列达到 3/4 (6 条) 之后每 3 条保留 1 条, 队列满后仍然丢弃
+	insertN(client, 15)
+	if got, want := drainQueue(client), recordNames(0, 1, 2, 3, 4, 5, 8, 11); !reflect.DeepEqual(got, want) {
+		t.Errorf("queued %v, want %v", got, want)
+	}
+	stats := client.InsertStats()
+	if stats.Queued != 8 || stats.Sampled != 6 || stats.Dropped != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestInsertOverflowSpool(t *testing.T) {
+	client := setupInsert(t, OverflowSpool, 0, 4)
+	var created []string
+	create := createDnslogs
+	t.Cleanup(func() { createDnslogs = create })
+	createDnslogs = func(client *DBClient, batch []Dnslog) error {
+		for _, record := range batch {
+			created = append(created, record.QueryName)
+		}
+		return nil
+	}
+
+	insertN(client, 7)
+	if stats := client.InsertStats(); stats.Queued != 4 || stats.Spooled != 3 || stats.Dropped != 0 {
+		t.Errorf("stats = %+v", stats)
+	}
+	if got, want := spooledNames(t), recordNames(4, 5, 6); !reflect.DeepEqual(got, want) {
+		t.Errorf("spooled %v, want %v", got, want)
+	}
+
+	// 队列繁忙时不补录
+	client.replaySpoolOnce()
+	if len(created) != 0 {
+		t.Fatalf("replayed while queue is busy: %v", created)
+	}
+	if got, want := drainQueue(client), recordNames(0, 1, 2, 3); !reflect.DeepEqual(got, want) {
+		t.Errorf("queued %v, want %v", got, want)
+	}
+
+	client.replaySpoolOnce()
+	if want := recordNames(4, 5, 6); !reflect.DeepEqual(created, want) {
+		t.Errorf("replayed %v, want %v", created, want)
+	}
+	if stats := client.InsertStats(); stats.Replayed != 3 {
+		t.Errorf("replayed = %d, want 3", stats.Replayed)
+	}
+	for _, file := range []string{spoolFile(), spoolFile() + ".replay"} {
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("%s still exists after replay", file)
+		}
+	}
+}
+
+// spooledNames 读取 spool 文件中的记录名
+func spooledNames(t *testing.T) []string {
+	t.Helper()
+	f, err := os.Open(spoolFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var names []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record Dnslog
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, record.QueryName)
+	}
+	return names
+}
@@ -0,0 +1,293 @@
+package db
+
+import (
+	"bflog/utils"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"math/rand"
+	"net"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 噪音规则的作用范围
+const (
+	NoiseScopeDns  = "dns"
+	NoiseScopeHttp = "http"
+)
+
+// 命中噪音规则后的处理方式
+const (
+	// NoiseIgnore 照常应答, 不记录
+	NoiseIgnore = "ignore"
+	// NoiseStore 记录但标记为噪音, 默认的日志列表中不显示
+	NoiseStore = "noise"
+	// NoiseSample 每 SampleRate 条记录一条到噪音中, 其余不记录
+	NoiseSample = "sample"
+)
+
+// noiseRefreshInterval 重新加载噪音规则并把命中次数写回数据库的间隔
+const noiseRefreshInterval = 10 * time.Second
+
+// NoiseRule 过滤扫描器, 解析器预取, 自身监控等噪音. 留空的条件不参与匹配, 所有条件都满足才算命中
+type NoiseRule struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Scope string `json:"scope"`
+	// SourceCidr 来源网段, 多个用逗号分隔
+	SourceCidr string `json:"source_cidr"`
+	// Qname 查询名的通配符, 例如 *.bfpiaoran.cn
+	Qname string `json:"qname"`
+	Qtype string `json:"qtype"`
+	// Path 请求路径的通配符, 例如 /static/*
+	Path string `json:"path"`
+	// UserAgent 不区分大小写的子串
+	UserAgent  string     `json:"user_agent"`
+	Method     string     `json:"method"`
+	Action     string     `json:"action"`
+	SampleRate int        `json:"sample_rate"`
+	Enabled    bool       `json:"enabled"`
+	Hits       int64      `json:"hits"`
+	LastHit    *time.Time `json:"last_hit"`
+}
+
+// noiseEntry 内存中的一条噪音规则, hits 为还没有写回数据库的命中次数.
+// 所有命中都计数, 包括不记录日志的 ignore 以及 sample 没有抽中的命中
+type noiseEntry struct {
+	rule    NoiseRule
+	nets    []*net.IPNet
+	hits    atomic.Int64
+	lastHit atomic.Int64
+}
+
+// noiseTable 当前生效的 []*noiseEntry, 按 ID 排序, 匹配时第一条命中的规则生效
+var noiseTable atomic.Value
+
+// ValidateNoiseRule 校验规则并统一大小写
+func ValidateNoiseRule(rule *NoiseRule) error {
+	rule.Scope = strings.ToLower(strings.TrimSpace(rule.Scope))
+	rule.Action = strings.ToLower(strings.TrimSpace(rule.Action))
+	rule.Qname = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(rule.Qname), "."))
+	rule.Qtype = strings.ToUpper(strings.TrimSpace(rule.Qtype))
+	rule.Method = strings.ToUpper(strings.TrimSpace(rule.Method))
+	switch rule.Scope {
+	case NoiseScopeDns:
+		if rule.Path != "" || rule.UserAgent != "" || rule.Method != "" {
+			return fmt.Errorf("dns 规则不能设置 path/user_agent/method")
+		}
+	case NoiseScopeHttp:
+		if rule.Qname != "" || rule.Qtype != "" {
+			return fmt.Errorf("http 规则不能设置 qname/qtype")
+		}
+	default:
+		return fmt.Errorf("scope 必须为 dns 或 http")
+	}
+	switch rule.Action {
+	case "":
+		rule.Action = NoiseIgnore
+	case NoiseIgnore, NoiseStore:
+	case NoiseSample:
+		if rule.SampleRate < 1 {
+			return fmt.Errorf("sample 规则需要设置 sample_rate")
+		}
+	default:
+		return fmt.Errorf("不支持的处理方式: %s", rule.Action)
+	}
+	if _, err := utils.ParseCidrs(rule.SourceCidr); err != nil {
+		return err
+	}
+	for _, pattern := range []string{rule.Qname, rule.Path} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("通配符错误: %s", pattern)
+		}
+	}
+	if rule.SourceCidr == "" && rule.Qname == "" && rule.Qtype == "" && rule.Path == "" && rule.UserAgent == "" && rule.Method == "" {
+		return fmt.Errorf("至少需要一个匹配条件")
+	}
+	return nil
+}
+
+// ReloadNoiseRules 重新加载全部启用的规则, 并把旧规则表中累计的命中次数写回数据库
+func (client *DBClient) ReloadNoiseRules() error {
+	var rules []NoiseRule
+	if err := client.Client.Where("enabled = ?", true).Order("id").Find(&rules).Error; err != nil {
+		return err
+	}
+	old, _ := noiseTable.Swap(newNoiseEntries(rules)).([]*noiseEntry)
+	client.flushNoiseHits(old)
+	return nil
+}
+
+// newNoiseEntries 把规则转换成内存中的规则表, 网段错误的规则跳过
+func newNoiseEntries(rules []NoiseRule) []*noiseEntry {
+	entries := make([]*noiseEntry, 0, len(rules))
+	for _, rule := range rules {
+		nets, err := utils.ParseCidrs(rule.SourceCidr)
+		if err != nil {
+			logrus.Warnf("skip noise rule %d: %v", rule.ID, err)
+			continue
+		}
+		entries = append(entries, &noiseEntry{rule: rule, nets: nets})
+	}
+	return entries
+}
+
+// flushNoiseHits 把规则表中累计的命中次数加到数据库中
+func (client *DBClient) flushNoiseHits(entries []*noiseEntry) {
+	for _, entry := range entries {
+		hits := entry.hits.Swap(0)
+		if hits == 0 {
+			continue
+		}
+		lastHit := time.Unix(0, entry.lastHit.Load())
+		err := client.Client.Model(&NoiseRule{}).Where("id = ?", entry.rule.ID).
+			Updates(map[string]interface{}{"hits": gorm.Expr("hits + ?", hits), "last_hit": lastHit}).Error
+		if err != nil {
+			logrus.Errorf("flush noise hits: %v", err)
+		}
+	}
+}
+
+// refreshNoiseRules 周期性写回命中次数并重新加载规则
+func (client *DBClient) refreshNoiseRules() {
+	ticker := time.NewTicker(noiseRefreshInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := client.ReloadNoiseRules(); err != nil {
+			logrus.Errorf("reload noise rules: %v", err)
+		}
+	}
+}
+
+// pendingNoiseHits 把还没有写回数据库的命中次数和最后命中时间加到规则上
+func pendingNoiseHits(rules []NoiseRule) {
+	pending := make(map[int]*noiseEntry)
+	entries, _ := noiseTable.Load().([]*noiseEntry)
+	for _, entry := range entries {
+		pending[entry.rule.ID] = entry
+	}
+	for i := range rules {
+		entry, ok := pending[rules[i].ID]
+		if !ok || entry.hits.Load() == 0 {
+			continue
+		}
+		rules[i].Hits += entry.hits.Load()
+		if lastHit := time.Unix(0, entry.lastHit.Load()); rules[i].LastHit == nil || lastHit.After(*rules[i].LastHit) {
+			rules[i].LastHit = &lastHit
+		}
+	}
+}
+
+// matchIP 来源地址是否属于规则的网段, 没有设置网段时视为匹配
+func (entry *noiseEntry) matchIP(ip net.IP) bool {
+	if len(entry.nets) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, network := range entry.nets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPattern(pattern string, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(pattern, value)
+	return ok
+}
+
+// hit 记录一次命中并返回处理结果, sample 规则没有抽中时返回 ignore
+func (entry *noiseEntry) hit() string {
+	entry.hits.Add(1)
+	entry.lastHit.Store(time.Now().UnixNano())
+	if entry.rule.Action == NoiseSample {
+		if rand.Intn(entry.rule.SampleRate) == 0 {
+			return NoiseStore
+		}
+		return NoiseIgnore
+	}
+	return entry.rule.Action
+}
+
+// MatchDnsNoise 返回 DNS 查询命中的噪音处理方式, 多条规则命中时 ID 最小的生效, 没有命中时返回空字符串
+func MatchDnsNoise(source string, qname string, qtype string) string {
+	entries, _ := noiseTable.Load().([]*noiseEntry)
+	ip := net.ParseIP(source)
+	qname = strings.ToLower(strings.TrimSuffix(qname, "."))
+	for _, entry := range entries {
+		rule := entry.rule
+		if rule.Scope != NoiseScopeDns || !entry.matchIP(ip) || !matchPattern(rule.Qname, qname) {
+			continue
+		}
+		if rule.Qtype != "" && !strings.EqualFold(rule.Qtype, qtype) {
+			continue
+		}
+		return entry.hit()
+	}
+	return ""
+}
+
+// MatchHttpNoise 返回 HTTP 请求命中的噪音处理方式, 多条规则命中时 ID 最小的生效, 没有命中时返回空字符串
+func MatchHttpNoise(source string, urlPath string, userAgent string, method string) string {
+	entries, _ := noiseTable.Load().([]*noiseEntry)
+	ip := net.ParseIP(source)
+	for _, entry := range entries {
+		rule := entry.rule
+		if rule.Scope != NoiseScopeHttp || !entry.matchIP(ip) || !matchPattern(rule.Path, urlPath) {
+			continue
+		}
+		if rule.UserAgent != "" && !strings.Contains(strings.ToLower(userAgent), strings.ToLower(rule.UserAgent)) {
+			continue
+		}
+		if rule.Method != "" && rule.Method != method {
+			continue
+		}
+		return entry.hit()
+	}
+	return ""
+}
+
+// GetNoiseRules 分页返回噪音规则, 命中次数和最后命中时间包含还没有写回数据库的部分
+func (client *DBClient) GetNoiseRules(scope string, page int, pageSize int) ([]NoiseRule, int, error) {
+	var rules []NoiseRule
+	var totalCount int64
+	query := client.Client.Model(&NoiseRule{})
+	if scope != "" {
+		query = query.Where("scope = ?", scope)
+	}
+	if err := query.Session(&gorm.Session{}).Count(&totalCount).Error; err != nil {
+		return nil, 0, err
+	}
+	err := query.Order("id").Offset((page - 1) * pageSize).Limit(pageSize).Find(&rules).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	pendingNoiseHits(rules)
+	return rules, int(totalCount), nil
+}
+
+func (client *DBClient) AddNoiseRule(rule NoiseRule) error {
+	rule.Hits = 0
+	rule.LastHit = nil
+	return client.Client.Create(&rule).Error
+}
+
+// UpdateNoiseRule 更新规则的条件, 不修改命中次数
+func (client *DBClient) UpdateNoiseRule(rule NoiseRule) error {
+	return client.Client.Model(&NoiseRule{}).Where("id = ?", rule.ID).
+		Select("name", "scope", "source_cidr", "qname", "qtype", "path", "user_agent", "method", "action", "sample_rate", "enabled").
+		Updates(&rule).Error
+}
+
+func (client *DBClient) DeleteNoiseRule(id int) error {
+	return client.Client.Delete(&NoiseRule{}, "id = ?", id).Error
+}
@@ -0,0 +1,106 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+// loadNoiseRules 用给定的规则替换内存中的规则表, 规则需要已经按 ID 排序
+func loadNoiseRules(t *testing.T, rules []NoiseRule) []*noiseEntry {
+	t.Helper()
+	for i := range rules {
+		if err := ValidateNoiseRule(&rules[i]); err != nil {
+			t.Fatalf("rule %d: %v", rules[i].ID, err)
+		}
+	}
+	entries := newNoiseEntries(rules)
+	noiseTable.Store(entries)
+	t.Cleanup(func() { noiseTable.Store([]*noiseEntry(nil)) })
+	return entries
+}
+
+func TestMatchDnsNoise(t *testing.T) {
+	loadNoiseRules(t, []NoiseRule{
+		{ID: 1, Scope: NoiseScopeDns, Qname: "*.scan.dnslog.test", Action: NoiseIgnore},
+		{ID: 2, Scope: NoiseScopeDns, SourceCidr: "10.0.0.0/8, 192.0.2.7", Action: NoiseStore},
+		{ID: 3, Scope: NoiseScopeDns, Qname: "*.dnslog.test", Qtype: "txt", Action: NoiseStore},
+		{ID: 4, Scope: NoiseScopeHttp, SourceCidr: "198.51.100.0/24", Action: NoiseIgnore},
+	})
+	tests := []struct {
+		source, qname, qtype string
+		want                 string
+	}{
+		// 多条规则命中时 ID 小的生效
+		{"10.1.2.3", "a.scan.dnslog.test", "A", NoiseIgnore},
+		{"10.1.2.3", "a.dnslog.test", "A", NoiseStore},
+		{"192.0.2.7", "a.dnslog.test", "A", NoiseStore},
+		{"192.0.2.8", "a.dnslog.test", "A", ""},
+		// 查询名不区分大小写, 忽略末尾的点
+		{"192.0.2.8", "A.Scan.DNSLOG.test.", "A", NoiseIgnore},
+		{"192.0.2.8", "a.dnslog.test", "TXT", NoiseStore},
+		{"192.0.2.8", "a.dnslog.test", "AAAA", ""},
+		// http 规则不影响 DNS 查询
+		{"198.51.100.1", "a.dnslog.test", "A", ""},
+		{"not-an-ip", "a.dnslog.test", "A", ""},
+	}
+	for _, tt := range tests {
+		if got := MatchDnsNoise(tt.source, tt.qname, tt.qtype); got != tt.want {
+			t.Errorf("MatchDnsNoise(%s, %s, %s) = %q, want %q", tt.source, tt.qname, tt.qtype, got, tt.want)
+		}
+	}
+}
+
+func TestMatchHttpNoise(t *testing.T) {
+	loadNoiseRules(t, []NoiseRule{
+		{ID: 1, Scope: NoiseScopeHttp, Path: "/static/*", Action: NoiseIgnore},
+		{ID: 2, Scope: NoiseScopeHttp, UserAgent: "zgrab", Action: NoiseStore},
+		{ID: 3, Scope: NoiseScopeHttp, SourceCidr: "2001:db8::/32", Method: "head", Action: NoiseIgnore},
+		{ID: 4, Scope: NoiseScopeDns, SourceCidr: "203.0.113.0/24", Action: NoiseIgnore},
+	})
+	tests := []struct {
+		source, path, ua, method string
+		want                     string
+	}{
+		{"203.0.113.1", "/static/app.js", "Mozilla/5.0 zgrab/0.x", "GET", NoiseIgnore},
+		{"203.0.113.1", "/static/js/app.js", "Mozilla/5.0 ZGrab/0.x", "GET", NoiseStore},
+		{"203.0.113.1", "/", "curl/8.0", "GET", ""},
+		{"2001:db8::1", "/", "curl/8.0", "HEAD", NoiseIgnore},
+		{"2001:db8::1", "/", "curl/8.0", "GET", ""},
+		// TLS 握手失败时只有来源地址
+		{"203.0.113.1", "", "", "", ""},
+	}
+	for _, tt := range tests {
+		if got := MatchHttpNoise(tt.source, tt.path, tt.ua, tt.method); got != tt.want {
+			t.Errorf("MatchHttpNoise(%s, %s, %q, %s) = %q, want %q", tt.source, tt.path, tt.ua, tt.method, got, tt.want)
+		}
+	}
+}
+
+func TestNoiseHits(t *testing.T) {
+	entries := loadNoiseRules(t, []NoiseRule{
+		{ID: 1, Scope: NoiseScopeDns, Qname: "ignore.dnslog.test", Action: NoiseIgnore},
+		{ID: 2, Scope: NoiseScopeDns, Qname: "sample.dnslog.test", Action: NoiseSample, SampleRate: 1},
+		{ID: 3, Scope: NoiseScopeDns, Qname: "idle.dnslog.test", Action: NoiseIgnore},
+	})
+	for i := 0; i < 3; i++ {
+		MatchDnsNoise("192.0.2.1", "ignore.dnslog.test", "A")
+	}
+	// sample_rate 为 1 时每次都记录
+	if got := MatchDnsNoise("192.0.2.1", "sample.dnslog.test", "A"); got != NoiseStore {
+		t.Errorf("sample rule = %q, want %q", got, NoiseStore)
+	}
+	if entries[0].hits.Load() != 3 || entries[1].hits.Load() != 1 || entries[2].hits.Load() != 0 {
+		t.Errorf("hits = %d %d %d, want 3 1 0", entries[0].hits.Load(), entries[1].hits.Load(), entries[2].hits.Load())
+	}
+
+	// 列表中的命中次数包含还没有写回数据库的部分
+	flushed := time.Now().Add(-time.Hour)
+	rules := []NoiseRule{{ID: 1, Hits: 10, LastHit: &flushed}, {ID: 2}, {ID: 3, Hits: 5, LastHit: &flushed}}
+	pendingNoiseHits(rules)
+	if rules[0].Hits != 13 || rules[1].Hits != 1 || rules[2].Hits != 5 {
+		t.Errorf("hits = %d %d %d, want 13 1 5", rules[0].Hits, rules[1].Hits, rules[2].Hits)
+	}
+	if !rules[0].LastHit.After(flushed) || rules[1].LastHit == nil || !rules[2].LastHit.Equal(flushed) {
+		t.Errorf("last_hit = %v %v %v", rules[0].LastHit, rules[1].LastHit, rules[2].LastHit)
+	}
+}
@@ -57,6 +57,18 @@ func (r *RedisClient) Get(key string) (string, error) {
 	return value, nil
 }
 
+// Peek 获取一个键的值, 键不存在时返回空字符串; 与 Get 不同, 只在出错时记录日志, 供查询路径上频繁调用
+func (r *RedisClient) Peek(key string) (string, error) {
+	value, err := r.client.Get(r.ctx, key).Result()
+	if err == redis.Nil {
+		return "", nil
+	} else if err != nil {
+		log.Errorf("Failed to get key %s: %v", key, err)
+		return "", err
+	}
+	return value, nil
+}
+
 // Del 删除一个键
 func (r *RedisClient) Del(key string) error {
 	err := r.client.Del(r.ctx, key).Err()
@@ -150,6 +162,36 @@ func (r *RedisClient) RPop(key string) (string, error) {
 	return value, nil
 }
 
+// Incr 原子地将键的值加一并返回新值
+func (r *RedisClient) Incr(key string) (int64, error) {
+	value, err := r.client.Incr(r.ctx, key).Result()
+	if err != nil {
+		log.Errorf("Failed to INCR key %s: %v", key, err)
+		return 0, err
+	}
+	return value, nil
+}
+
+// Expire 设置键的过期时间
+func (r *RedisClient) Expire(key string, expiration time.Duration) error {
+	err := r.client.Expire(r.ctx, key, expiration).Err()
+	if err != nil {
+		log.Errorf("Failed to EXPIRE key %s: %v", key, err)
+		return err
+	}
+	return nil
+}
+
+// SetNX 仅在键不存在时设置值, 返回是否设置成功
+func (r *RedisClient) SetNX(key string, value interface{}, expiration time.Duration) (bool, error) {
+	ok, err := r.client.SetNX(r.ctx, key, value, expiration).Result()
+	if err != nil {
+		log.Errorf("Failed to SETNX key %s: %v", key, err)
+		return false, err
+	}
+	return ok, nil
+}
+
 func InitRedisDB() {
 	redisClient := NewRedisClient("localhost:6379", "", 0)
 	redisdb = redisClient
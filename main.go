@@ -7,6 +7,7 @@ import (
 	"bflog/config"
 	"bflog/db"
 	"context"
+	"flag"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/bcrypt"
@@ -43,6 +44,8 @@ func start() {
 	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-sigCh
+		// 先停止 DNS 查询处理, 避免关闭写库通道之后还有查询在发送
+		DnsServer.Stop()
 		db.GetDB().Close()
 		fmt.Println("server stop")
 		cancel()
@@ -79,9 +82,92 @@ func initOnly(username, password string) {
 	fmt.Println("User inserted successfully:", username)
 }
 
+// printDS 加载或生成 DNSSEC 密钥并输出要提交给注册商的 DS 记录
+func printDS() {
+	err := config.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, zone := range DnsServer.ZoneNames() {
+		if err := DnsServer.LoadDnssecKeys(zone); err != nil {
+			log.Fatal(err)
+		}
+		records, err := DnsServer.DSRecords(zone)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, ds := range records {
+			fmt.Println(ds.String())
+		}
+	}
+}
+
+// zoneCommand 导入或导出区域文件:
+//
+//	bflog zone import [-apply] [-origin zone] file
+//	bflog zone export [-origin zone] [-o file]
+func zoneCommand(args []string) {
+	if len(args) < 1 {
+		log.Fatal("请提供 import 或 export")
+	}
+	fs := flag.NewFlagSet("zone "+args[0], flag.ExitOnError)
+	origin := fs.String("origin", "", "区域名, 导入时作为相对名称的 $ORIGIN, 导出时只导出该区域的规则")
+	apply := fs.Bool("apply", false, "写入数据库, 默认只预览")
+	output := fs.String("o", "", "导出的文件, 默认输出到标准输出")
+	_ = fs.Parse(args[1:])
+
+	if err := config.Init(); err != nil {
+		log.Fatal(err)
+	}
+	db.InitDB()
+	switch args[0] {
+	case "import":
+		if fs.NArg() < 1 {
+			log.Fatal("请提供区域文件")
+		}
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		result, err := DnsServer.ImportZoneFile(f, *origin, *apply)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, rule := range result.Created {
+			fmt.Printf("+ %s %s %q\n", rule.Name, rule.Type, []string(rule.IPAddresses))
+		}
+		for _, rule := range result.Updated {
+			fmt.Printf("~ %s %s %q\n", rule.Name, rule.Type, []string(rule.IPAddresses))
+		}
+		for _, reason := range result.Skipped {
+			fmt.Printf("! %s\n", reason)
+		}
+		fmt.Printf("新增 %d, 更新 %d, 未变化 %d, 跳过 %d\n", len(result.Created), len(result.Updated), result.Unchanged, len(result.Skipped))
+		if !result.Applied {
+			fmt.Println("预览模式, 没有写入数据库, 使用 -apply 导入")
+		}
+	case "export":
+		out := os.Stdout
+		if *output != "" {
+			f, err := os.Create(*output)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			out = f
+		}
+		if err := DnsServer.ExportZoneFile(out, *origin); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatal("请提供 import 或 export")
+	}
+}
+
 func main() {
 	if len(os.Args) < 2 {
-		log.Fatal("请提供一个参数: start 或 init")
+		log.Fatal("请提供一个参数: start, init, ds 或 zone")
 	}
 
 	arg := os.Args[1]
@@ -97,6 +183,10 @@ func main() {
 		// 执行 init 参数的逻辑
 
 		initOnly(username, password)
+	case "ds":
+		printDS()
+	case "zone":
+		zoneCommand(os.Args[2:])
 	}
 
 }
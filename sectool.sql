@@ -17,6 +17,34 @@
 SET NAMES utf8mb4;
 SET FOREIGN_KEY_CHECKS = 0;
 
+-- ----------------------------
+-- Table structure for acme_account
+-- ----------------------------
+DROP TABLE IF EXISTS `acme_account`;
+CREATE TABLE `acme_account` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `username` varchar(36) NOT NULL,
+  `password` varchar(255) NOT NULL,
+  `subdomain` varchar(36) NOT NULL,
+  `allow_from` text,
+  `created_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `uniq_username` (`username`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+-- ----------------------------
+-- Table structure for acme_txt
+-- ----------------------------
+DROP TABLE IF EXISTS `acme_txt`;
+CREATE TABLE `acme_txt` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `subdomain` varchar(36) NOT NULL,
+  `value` varchar(255) NOT NULL DEFAULT '',
+  `last_update` datetime(6) DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_subdomain` (`subdomain`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
 -- ----------------------------
 -- Table structure for dns_rule
 -- ----------------------------
@@ -24,7 +52,15 @@ DROP TABLE IF EXISTS `dns_rule`;
 CREATE TABLE `dns_rule` (
   `id` int(11) NOT NULL AUTO_INCREMENT,
   `name` varchar(255) NOT NULL,
+  `type` varchar(16) NOT NULL DEFAULT 'A',
   `ip_addresses` text NOT NULL,
+  `strategy` varchar(32) NOT NULL DEFAULT '',
+  `strategy_arg` int(11) NOT NULL DEFAULT 0,
+  `match_type` varchar(16) NOT NULL DEFAULT '',
+  `priority` int(11) NOT NULL DEFAULT 0,
+  `ttl` int(10) unsigned DEFAULT NULL,
+  `probe` varchar(16) NOT NULL DEFAULT '',
+  `probe_arg` int(11) NOT NULL DEFAULT 0,
   PRIMARY KEY (`id`)
 ) ENGINE=InnoDB AUTO_INCREMENT=9 DEFAULT CHARSET=utf8;
 
@@ -36,11 +72,64 @@ CREATE TABLE `dnslog` (
   `id` int(11) NOT NULL AUTO_INCREMENT,
   `receive_ip` varchar(255) DEFAULT NULL,
   `query_name` varchar(255) DEFAULT NULL,
+  `raw_name` varchar(255) DEFAULT NULL,
   `query_type` varchar(255) DEFAULT NULL,
+  `query_class` varchar(16) DEFAULT NULL,
+  `transaction_id` int(11) DEFAULT NULL,
+  `recursion_desired` tinyint(1) DEFAULT NULL,
+  `checking_disabled` tinyint(1) DEFAULT NULL,
+  `dnssec_ok` tinyint(1) DEFAULT NULL,
+  `edns_size` int(11) DEFAULT NULL,
+  `client_subnet` varchar(64) DEFAULT NULL,
+  `transport` varchar(8) DEFAULT NULL,
+  `ttl` int(10) unsigned DEFAULT NULL,
+  `zone` varchar(255) NOT NULL DEFAULT '',
+  `noise` tinyint(1) NOT NULL DEFAULT 0,
+  `resolver_tag` varchar(32) NOT NULL DEFAULT '',
+  `probe` varchar(16) NOT NULL DEFAULT '',
+  `probe_id` varchar(16) NOT NULL DEFAULT '',
+  `answer` text,
   `created_time` datetime(6) DEFAULT NULL ON UPDATE CURRENT_TIMESTAMP(6),
-  PRIMARY KEY (`id`)
+  PRIMARY KEY (`id`),
+  KEY `idx_probe_id` (`probe_id`)
 ) ENGINE=InnoDB AUTO_INCREMENT=37 DEFAULT CHARSET=utf8;
 
+-- ----------------------------
+-- Table structure for exfil_chunk
+-- ----------------------------
+DROP TABLE IF EXISTS `exfil_chunk`;
+CREATE TABLE `exfil_chunk` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `token` varchar(63) NOT NULL,
+  `seq` int(11) NOT NULL,
+  `total` int(11) NOT NULL DEFAULT 0,
+  `data` varchar(63) NOT NULL,
+  `receive_ip` varchar(255) DEFAULT NULL,
+  `created_time` datetime(6) DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `uniq_token_seq` (`token`, `seq`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+-- ----------------------------
+-- Table structure for forward_log
+-- ----------------------------
+DROP TABLE IF EXISTS `forward_log`;
+CREATE TABLE `forward_log` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `receive_ip` varchar(255) DEFAULT NULL,
+  `query_name` varchar(255) DEFAULT NULL,
+  `query_type` varchar(16) DEFAULT NULL,
+  `transport` varchar(8) DEFAULT NULL,
+  `upstream` varchar(255) NOT NULL DEFAULT '',
+  `cached` tinyint(1) NOT NULL DEFAULT 0,
+  `rcode` varchar(16) DEFAULT NULL,
+  `answer` text,
+  `duration` int(11) NOT NULL DEFAULT 0,
+  `created_time` datetime(6) DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_created_time` (`created_time`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
 -- ----------------------------
 -- Table structure for http_request_log
 -- ----------------------------
@@ -55,6 +144,16 @@ CREATE TABLE `http_request_log` (
   `header` text NOT NULL,
   `body` text NOT NULL,
   `path` text NOT NULL,
+  `zone` varchar(255) NOT NULL DEFAULT '',
+  `noise` tinyint(1) NOT NULL DEFAULT 0,
+  `request_id` varchar(16) NOT NULL DEFAULT '',
+  `sni` varchar(255) NOT NULL DEFAULT '',
+  `alpn` varchar(255) NOT NULL DEFAULT '',
+  `tls_version` varchar(16) NOT NULL DEFAULT '',
+  `tls_ciphers` text,
+  `ja3` varchar(32) NOT NULL DEFAULT '',
+  `ja4` varchar(64) NOT NULL DEFAULT '',
+  `tls_error` varchar(255) NOT NULL DEFAULT '',
   PRIMARY KEY (`ID`)
 ) ENGINE=InnoDB AUTO_INCREMENT=58 DEFAULT CHARSET=utf8;
 
@@ -70,10 +169,35 @@ CREATE TABLE `http_response` (
   `redirect_url` varchar(255) DEFAULT NULL,
   `header` json DEFAULT NULL,
   `body` text,
+  `match_type` varchar(16) NOT NULL DEFAULT '',
+  `priority` int(11) NOT NULL DEFAULT 0,
+  `hostname` varchar(255) NOT NULL DEFAULT '',
   `create_at` timestamp NULL DEFAULT NULL ON UPDATE CURRENT_TIMESTAMP,
   PRIMARY KEY (`ID`)
 ) ENGINE=InnoDB AUTO_INCREMENT=4 DEFAULT CHARSET=utf8;
 
+-- ----------------------------
+-- Table structure for noise_rule
+-- ----------------------------
+DROP TABLE IF EXISTS `noise_rule`;
+CREATE TABLE `noise_rule` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `name` varchar(255) NOT NULL DEFAULT '',
+  `scope` varchar(8) NOT NULL,
+  `source_cidr` text,
+  `qname` varchar(255) NOT NULL DEFAULT '',
+  `qtype` varchar(16) NOT NULL DEFAULT '',
+  `path` varchar(255) NOT NULL DEFAULT '',
+  `user_agent` varchar(255) NOT NULL DEFAULT '',
+  `method` varchar(16) NOT NULL DEFAULT '',
+  `action` varchar(16) NOT NULL DEFAULT 'ignore',
+  `sample_rate` int(11) NOT NULL DEFAULT 0,
+  `enabled` tinyint(1) NOT NULL DEFAULT 1,
+  `hits` bigint(20) NOT NULL DEFAULT 0,
+  `last_hit` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
 -- ----------------------------
 -- Table structure for user
 -- ----------------------------
@@ -1,9 +1,12 @@
 package utils
 
 import (
+	"fmt"
 	"gorm.io/gorm"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -30,6 +33,71 @@ type HttpRuleFilter struct {
 	PageSize   int       `json:"perPage"`
 }
 
+// DnslogFilter dnslog 的过滤条件, 指针字段为 nil 时不过滤
+type DnslogFilter struct {
+	ReceiveIP        string
+	QueryName        string
+	QueryType        string
+	RawName          string
+	QueryClass       string
+	TransactionID    *int
+	RecursionDesired *bool
+	CheckingDisabled *bool
+	DnssecOK         *bool
+	ClientSubnet     string
+	Transport        string
+	Zone             string
+	// Noise 为 true 时只查询噪音记录, 否则只查询正常记录
+	Noise bool
+	// Resolver 为解析器标签, unknown 表示不属于任何已知的公共解析器
+	Resolver string
+	Answer   string
+	// Probe 为探测方式, ProbeID 查询同一次探测触发的全部查询
+	Probe   string
+	ProbeID string
+}
+
+// ParseDnslogFilter 从请求中解析 dnslog 过滤参数
+func ParseDnslogFilter(r *http.Request) (*DnslogFilter, error) {
+	q := r.URL.Query()
+	filter := &DnslogFilter{
+		ReceiveIP:    q.Get("receiveip"),
+		QueryName:    q.Get("queryname"),
+		QueryType:    q.Get("querytype"),
+		RawName:      q.Get("rawname"),
+		QueryClass:   q.Get("queryclass"),
+		ClientSubnet: q.Get("client_subnet"),
+		Transport:    q.Get("transport"),
+		Zone:         q.Get("zone"),
+		Noise:        q.Get("noise") == "1" || q.Get("noise") == "true",
+		Resolver:     q.Get("resolver"),
+		Answer:       q.Get("answer"),
+		Probe:        q.Get("probe"),
+		ProbeID:      q.Get("probe_id"),
+	}
+	if v := q.Get("txid"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		filter.TransactionID = &id
+	}
+	for name, dst := range map[string]**bool{
+		"rd": &filter.RecursionDesired,
+		"cd": &filter.CheckingDisabled,
+		"do": &filter.DnssecOK,
+	} {
+		if v := q.Get(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, err
+			}
+			*dst = &b
+		}
+	}
+	return filter, nil
+}
+
 // ParsePaginationAndTimeFilter 从请求中解析分页和时间过滤参数
 func ParsePaginationAndTimeFilter(r *http.Request) (*PaginationAndTimeFilter, error) {
 	page := 1
@@ -99,3 +167,30 @@ func ApplyPaginationAndTimeFilter(query *gorm.DB, filter *PaginationAndTimeFilte
 	offset := (filter.Page - 1) * filter.PageSize
 	return query.Offset(offset).Limit(filter.PageSize)
 }
+
+// ParseCidrs 解析网段列表, 每一项可以是逗号分隔的多个网段, 单个地址视为 /32 或 /128
+func ParseCidrs(values ...string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, value := range values {
+		for _, cidr := range strings.Split(value, ",") {
+			cidr = strings.TrimSpace(cidr)
+			if cidr == "" {
+				continue
+			}
+			prefix := cidr
+			if !strings.Contains(prefix, "/") {
+				if ip := net.ParseIP(prefix); ip != nil && ip.To4() != nil {
+					prefix += "/32"
+				} else {
+					prefix += "/128"
+				}
+			}
+			_, network, err := net.ParseCIDR(prefix)
+			if err != nil {
+				return nil, fmt.Errorf("网段错误: %s", cidr)
+			}
+			nets = append(nets, network)
+		}
+	}
+	return nets, nil
+}